@@ -0,0 +1,474 @@
+/*
+*
+* REST API.
+* JSON endpoints under /api to create, inspect and end sessions, list
+* their players and cards, and draw. A request runs its commands through
+* a connection-less admin client, the way a websocket would, so it
+* reaches the session wherever it is run and is checked against the
+* role of the host. Hosts pass their host token or invite as a bearer
+* token.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Time a request waits for the session to answer.
+//
+const (
+	API_TIMEOUT = 5 * time.Second
+)
+
+type APIError struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+type CreateSessionReq struct {
+	SessionId string `json:"session_id"`
+}
+
+type SessionCreated struct {
+	Session_Id string `json:"session_id"`
+	Game_Link  string `json:"game_link"`
+	Host_Token string `json:"host_token"`
+}
+
+type SessionSummary struct {
+	Session_Id string `json:"session_id"`
+	// Role the bearer token gives in the session.
+	Role       string `json:"role"`
+	Players    int    `json:"players"`
+	Draws      int    `json:"draws"`
+	Game_State string `json:"game_state"`
+}
+
+type SessionList struct {
+	Instance string           `json:"instance"`
+	Sessions []SessionSummary `json:"sessions"`
+}
+
+type PlayerList struct {
+	Session_Id string           `json:"session_id"`
+	Players    []SnapshotPlayer `json:"players"`
+}
+
+type DrawList struct {
+	Session_Id string `json:"session_id"`
+	Draws      []int  `json:"draws"`
+	Game_State string `json:"game_state"`
+}
+
+type DrawResp struct {
+	Session_Id  string `json:"session_id"`
+	Draw_Number int    `json:"draw_number"`
+	Seq         int64  `json:"seq"`
+	Winner      string `json:"winner,omitempty"`
+}
+
+// A connection-less admin client running the commands of a request.
+type apiClient struct {
+	*Client
+	requests int
+}
+
+// newAPIClient returns the client of a request running cmdType, empty
+// for reads, or the error of a request over the limits of its IP.
+func newAPIClient(r *http.Request, cmdType string) (*apiClient, error) {
+	if err := limitAPI(r, cmdType); err != nil {
+		return nil, err
+	}
+	c := NewClient(nil, ROLE_ADMIN)
+	c.addr = r.RemoteAddr
+	c.request = true
+	return &apiClient{Client: c}, nil
+}
+
+func (c *apiClient) close() {
+	c.leaveSession()
+	c.Close(websocket.CloseNormalClosure, "")
+	untrackClient(c.Client)
+}
+
+// run sends a command and returns the payload of its ack, or the error
+// it was answered with.
+func (c *apiClient) run(cmdType string, payload interface{}) (json.RawMessage, error) {
+	c.requests++
+	cmd := Command{Version: PROTOCOL_VERSION, Type: cmdType, RequestId: "api-" + strconv.Itoa(c.requests)}
+	cmd.Payload, _ = json.Marshal(payload)
+	msg, _ := json.Marshal(cmd)
+	c.handleMessage(msg)
+	for {
+		data, err := c.next("")
+		if err != nil {
+			return nil, err
+		}
+		var reply struct {
+			CommandReply
+			Payload json.RawMessage `json:"payload"`
+		}
+		if json.Unmarshal(data, &reply) != nil || reply.RequestId != cmd.RequestId {
+			continue
+		}
+		if reply.Msg_Type == REPLY_ERROR {
+			return nil, NewProtocolError(reply.Code, "%s", reply.Error)
+		}
+		return reply.Payload, nil
+	}
+}
+
+// next returns the next message of msgType the client is sent, any
+// message when msgType is empty.
+func (c *apiClient) next(msgType string) ([]byte, error) {
+	timeout := time.NewTimer(API_TIMEOUT)
+	defer timeout.Stop()
+	for {
+		select {
+		case out, ok := <-c.send:
+			if !ok {
+				return nil, NewProtocolError(ERR_INTERNAL, "session closed the request: %s", c.closeReason)
+			}
+			if msgType == "" || messageType(out.data) == msgType {
+				return out.data, nil
+			}
+		case <-timeout.C:
+			return nil, NewProtocolError(ERR_INTERNAL, "session didn't answer in %v", API_TIMEOUT)
+		}
+	}
+}
+
+// join joins the session as the host of the bearer token and returns
+// the session snapshot, with the cards of the players when cards is set.
+func (c *apiClient) join(r *http.Request, cards bool) (*SessionSnapshot, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	_, err := c.run(CMD_STATUS, SessionPayload{SessionId: mux.Vars(r)["sessId"], HostToken: token, Cards: cards})
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.next("session_snapshot")
+	if err != nil {
+		return nil, err
+	}
+	var snapshot SessionSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// apiStatus maps an error code onto an HTTP status.
+func apiStatus(code string) int {
+	switch code {
+	case ERR_SESSION_NOT_FOUND:
+		return http.StatusNotFound
+	case ERR_SESSION_EXISTS, ERR_ALL_DRAWN:
+		return http.StatusConflict
+	case ERR_GAME_OVER:
+		return http.StatusGone
+	case ERR_FORBIDDEN:
+		return http.StatusForbidden
+	case ERR_INVALID_TOKEN:
+		return http.StatusUnauthorized
+	case ERR_INVALID_COMMAND, ERR_INVALID_PAYLOAD:
+		return http.StatusBadRequest
+	case ERR_RATE_LIMITED:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+func writeAPI(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	pErr := asProtocolError(err)
+	log.Println("api error:", pErr)
+	writeAPI(w, apiStatus(pErr.Code), APIError{Code: pErr.Code, Error: pErr.Message})
+}
+
+// activeSession answers for a session that isn't running, false then.
+func activeSession(w http.ResponseWriter, sessionId string) bool {
+	if sessionActive(sessionId) {
+		return true
+	}
+	writeAPIError(w, sessionNotFound(sessionId))
+	return false
+}
+
+// ListSessions lists the sessions run by this instance the bearer token
+// is a host of. Ids of sessions hold their secret phrase, so none are
+// listed without a token.
+func ListSessions(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		writeAPIError(w, NewProtocolError(ERR_FORBIDDEN, "listing sessions needs a host token or invite"))
+		return
+	}
+	if err := limitAPI(r, ""); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	gamesLock.Lock()
+	hubs := make([]*SessionHub, 0, len(games.activeSessions))
+	for _, b := range games.activeSessions {
+		hubs = append(hubs, b.hub)
+	}
+	gamesLock.Unlock()
+
+	list := SessionList{Instance: instanceId, Sessions: make([]SessionSummary, 0, len(hubs))}
+	for _, hub := range hubs {
+		hub.call(func() {
+			role, err := hub.tokenRole(token)
+			if err != nil {
+				return
+			}
+			list.Sessions = append(list.Sessions, SessionSummary{Session_Id: hub.game.GameId,
+				Role:       role,
+				Players:    len(hub.game.GamePlayers),
+				Draws:      hub.game.drawCount,
+				Game_State: hub.game.state()})
+		})
+	}
+	sort.Slice(list.Sessions, func(i, j int) bool {
+		return list.Sessions[i].Session_Id < list.Sessions[j].Session_Id
+	})
+	writeAPI(w, http.StatusOK, list)
+}
+
+// CreateSession opens a session, the caller becomes its owner.
+func CreateSession(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	var req CreateSessionReq
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, serverConfig.ReadLimit))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil || req.SessionId == "" {
+		writeAPIError(w, NewProtocolError(ERR_INVALID_PAYLOAD, "session_id is required"))
+		return
+	}
+	if sessionActive(req.SessionId) {
+		writeAPIError(w, NewProtocolError(ERR_SESSION_EXISTS, "session already exists: %s", req.SessionId))
+		return
+	}
+
+	c, err := newAPIClient(r, CMD_STATUS)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	ack, err := c.run(CMD_STATUS, SessionPayload{SessionId: req.SessionId})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var status struct {
+		Game_Link  string `json:"game_link"`
+		Host_Token string `json:"host_token"`
+	}
+	json.Unmarshal(ack, &status)
+	writeAPI(w, http.StatusCreated, SessionCreated{Session_Id: req.SessionId,
+		Game_Link:  status.Game_Link,
+		Host_Token: status.Host_Token})
+}
+
+// GetSession returns the snapshot of a session.
+func GetSession(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	if !activeSession(w, mux.Vars(r)["sessId"]) {
+		return
+	}
+	c, err := newAPIClient(r, "")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	snapshot, err := c.join(r, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, snapshot)
+}
+
+// EndSession ends a session without a winner.
+func EndSession(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	sessionId := mux.Vars(r)["sessId"]
+	if !activeSession(w, sessionId) {
+		return
+	}
+	c, err := newAPIClient(r, CMD_END_SESSION)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	_, err = c.join(r, false)
+	if err == nil {
+		_, err = c.run(CMD_END_SESSION, SessionPayload{SessionId: sessionId})
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, StatusResp{Status: true})
+}
+
+// ListPlayers returns the roster of a session with the players' cards.
+func ListPlayers(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	if !activeSession(w, mux.Vars(r)["sessId"]) {
+		return
+	}
+	c, err := newAPIClient(r, "")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	snapshot, err := c.join(r, true)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, PlayerList{Session_Id: snapshot.Session_Id, Players: snapshot.Players})
+}
+
+// ListDraws returns the numbers drawn so far in draw order.
+func ListDraws(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	if !activeSession(w, mux.Vars(r)["sessId"]) {
+		return
+	}
+	c, err := newAPIClient(r, "")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	snapshot, err := c.join(r, false)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, DrawList{Session_Id: snapshot.Session_Id,
+		Draws:      snapshot.Draws,
+		Game_State: snapshot.Game_State})
+}
+
+// Draw draws the next number of a session.
+func Draw(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	sessionId := mux.Vars(r)["sessId"]
+	if !activeSession(w, sessionId) {
+		return
+	}
+	c, err := newAPIClient(r, CMD_DRAW_NUMBER)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	_, err = c.join(r, false)
+	if err == nil {
+		_, err = c.run(CMD_DRAW_NUMBER, SessionPayload{SessionId: sessionId})
+	}
+	var data []byte
+	if err == nil {
+		data, err = c.next("draw_number")
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var draw WebMsgOut
+	json.Unmarshal(data, &draw)
+	writeAPI(w, http.StatusCreated, DrawResp{Session_Id: sessionId,
+		Draw_Number: draw.Draw_Number,
+		Seq:         draw.Seq,
+		Winner:      draw.Player_Name})
+}
+
+// AddWebhook subscribes a webhook to the events of a session.
+func AddWebhook(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	sessionId := mux.Vars(r)["sessId"]
+	var req AddWebhookPayload
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, serverConfig.ReadLimit))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeAPIError(w, NewProtocolError(ERR_INVALID_PAYLOAD, "malformed webhook: %v", err))
+		return
+	}
+	if !activeSession(w, sessionId) {
+		return
+	}
+	c, err := newAPIClient(r, CMD_ADD_WEBHOOK)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	var ack json.RawMessage
+	_, err = c.join(r, false)
+	if err == nil {
+		req.SessionId = sessionId
+		ack, err = c.run(CMD_ADD_WEBHOOK, req)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var added WebhookAdded
+	json.Unmarshal(ack, &added)
+	writeAPI(w, http.StatusCreated, added)
+}
+
+// RemoveWebhook drops a webhook of a session.
+func RemoveWebhook(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	sessionId := mux.Vars(r)["sessId"]
+	if !activeSession(w, sessionId) {
+		return
+	}
+	c, err := newAPIClient(r, CMD_REMOVE_WEBHOOK)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	defer c.close()
+	_, err = c.join(r, false)
+	if err == nil {
+		_, err = c.run(CMD_REMOVE_WEBHOOK, RemoveWebhookPayload{SessionId: sessionId, WebhookId: mux.Vars(r)["hookId"]})
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, StatusResp{Status: true})
+}
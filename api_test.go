@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIRateLimit(t *testing.T) {
+	apiLimitersLock.Lock()
+	apiLimiters = make(map[string]*apiLimiter)
+	apiLimitersLock.Unlock()
+	srv := httptest.NewServer(NewRouter())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/sessions", "application/json", strings.NewReader(`{"session_id":"limited"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created SessionCreated
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal(resp.Status)
+	}
+
+	// Draws over REST share the bucket of their IP.
+	limit := int(commandLimits[CMD_DRAW_NUMBER].Burst)
+	for i := 0; i <= limit; i++ {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/sessions/limited/draws", nil)
+		req.Header.Set("Authorization", "Bearer "+created.Host_Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		want := http.StatusCreated
+		if i == limit {
+			want = http.StatusTooManyRequests
+		}
+		if resp.StatusCode != want {
+			t.Fatalf("draw %d: %s", i+1, resp.Status)
+		}
+	}
+}
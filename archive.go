@@ -0,0 +1,453 @@
+/*
+*
+* Game history.
+* A finished game is archived with its log, from which the history API
+* rebuilds the roster, the cards, the draws with their times and the
+* winners. Hosts verify prizes with the report of a game, exported as
+* JSON, CSV or a printable HTML page. Reports need the host token the
+* owner had when the game ended.
+*
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Formats a report is exported in.
+//
+const (
+	EXPORT_JSON = "json"
+	EXPORT_CSV  = "csv"
+	EXPORT_HTML = "html"
+)
+
+// A finished game as kept in the archive.
+type ArchivedGame struct {
+	ArchiveId  string      `json:"archive_id"`
+	SessionId  string      `json:"session_id"`
+	OwnerToken string      `json:"owner_token,omitempty"`
+	Ended      int64       `json:"ended"`
+	Events     []GameEvent `json:"events"`
+}
+
+// Archived game in the history list.
+type GameSummary struct {
+	Archive_Id string    `json:"archive_id"`
+	Session_Id string    `json:"session_id"`
+	Started    time.Time `json:"started"`
+	Ended      time.Time `json:"ended"`
+	Players    int       `json:"players"`
+	Draws      int       `json:"draws"`
+	Winners    []string  `json:"winners"`
+}
+
+// Summary of an archived game, the names of its players and the token
+// of its owner, as listed in the history.
+type historyEntry struct {
+	summary    GameSummary
+	players    map[string]bool
+	ownerToken string
+}
+
+// The history of the store it was loaded from, kept up to date as games
+// are archived, so listing it doesn't replay every archived game.
+var historyStore SessionStore
+var historyEntries map[string]*historyEntry
+var historyLock sync.Mutex
+
+type HistoryList struct {
+	Games []GameSummary `json:"games"`
+}
+
+type ReportDraw struct {
+	Order       int       `json:"order"`
+	Draw_Number int       `json:"draw_number"`
+	Drawn       time.Time `json:"drawn"`
+}
+
+type ReportPlayer struct {
+	Player_Name string    `json:"player_name"`
+	Joined      time.Time `json:"joined"`
+	// Cards dealt to the player, re-rolls included.
+	Cards        int      `json:"cards"`
+	Player_Sheet [][]int  `json:"player_sheet"`
+	Marks        [][]bool `json:"marks"`
+	Winner       bool     `json:"winner"`
+	// Set for players who left the game, with the last card they had.
+	Left bool `json:"left,omitempty"`
+}
+
+// Results of a finished game.
+type GameReport struct {
+	Archive_Id string         `json:"archive_id"`
+	Session_Id string         `json:"session_id"`
+	Game_Link  string         `json:"game_link"`
+	Started    time.Time      `json:"started"`
+	Ended      time.Time      `json:"ended"`
+	Pattern    string         `json:"pattern"`
+	Winners    []string       `json:"winners"`
+	Players    []ReportPlayer `json:"players"`
+	Draws      []ReportDraw   `json:"draws"`
+}
+
+// A cell of a card on the printable report.
+type reportCell struct {
+	Number int
+	Free   bool
+	Drawn  bool
+}
+
+// archiveGame moves a finished game from the stored sessions to the
+// archive.
+func archiveGame(b *BingoGame, ownerToken string) {
+	ended := time.Now()
+	if len(b.gameLog) > 0 {
+		ended = time.Unix(b.gameLog[len(b.gameLog)-1].Time, 0)
+	}
+	events := b.GameLog()
+	game := &ArchivedGame{ArchiveId: archiveId(b.GameId, ended, ownerToken, events),
+		SessionId:  b.GameId,
+		OwnerToken: ownerToken,
+		Ended:      ended.Unix(),
+		Events:     events}
+	if err := sessionStore.Archive(game); err != nil {
+		log.Println("couldn't archive session", b.GameId, err)
+		return
+	}
+	historyLock.Lock()
+	if historyStore == sessionStore {
+		addHistory(game)
+	}
+	historyLock.Unlock()
+	if err := sessionStore.Delete(b.GameId); err != nil {
+		log.Println("couldn't drop stored session", b.GameId, err)
+	}
+	log.Println("Session archived:", game.ArchiveId)
+}
+
+// archiveId names an archived game after its session and end, with a
+// digest of its owner and log so games of a session that end in the
+// same second don't overwrite each other. Archiving the same game again
+// gives the same id.
+func archiveId(sessionId string, ended time.Time, ownerToken string, events []GameEvent) string {
+	digest := sha256.New()
+	digest.Write([]byte(ownerToken))
+	json.NewEncoder(digest).Encode(events)
+	return sessionId + "-" + strconv.FormatInt(ended.Unix(), 10) + "-" + hex.EncodeToString(digest.Sum(nil)[:4])
+}
+
+// report rebuilds the results of an archived game from its log.
+func (game *ArchivedGame) report() (*GameReport, error) {
+	b, err := ReplayGame(game.Events)
+	if err != nil {
+		return nil, err
+	}
+	report := &GameReport{Archive_Id: game.ArchiveId,
+		Session_Id: game.SessionId,
+		Game_Link:  b.GameLink,
+		Started:    time.Unix(game.Events[0].Time, 0),
+		Ended:      time.Unix(game.Ended, 0),
+		Pattern:    b.pattern(),
+		Winners:    append([]string{}, b.winners...),
+		Players:    make([]ReportPlayer, 0),
+		Draws:      make([]ReportDraw, 0, b.drawCount)}
+
+	winners := make(map[string]bool)
+	for _, winner := range b.winners {
+		winners[winner] = true
+	}
+	draws := b.drawnNumbers()
+	players := make(map[string]*ReportPlayer)
+	dealtAt := make(map[string]int)
+	for _, ev := range game.Events {
+		switch ev.Type {
+		case GAME_EVENT_PLAYER_JOINED:
+			players[ev.PlayerName] = &ReportPlayer{Player_Name: ev.PlayerName, Joined: time.Unix(ev.Time, 0)}
+		case GAME_EVENT_CARD_DEALT:
+			players[ev.PlayerName].Cards = ev.SheetId
+			players[ev.PlayerName].Player_Sheet = ev.Sheet
+			dealtAt[ev.PlayerName] = len(report.Draws)
+		case GAME_EVENT_NUMBER_DRAWN:
+			report.Draws = append(report.Draws, ReportDraw{Order: len(report.Draws) + 1,
+				Draw_Number: ev.DrawNumber,
+				Drawn:       time.Unix(ev.Time, 0)})
+		}
+	}
+	for name, player := range players {
+		_, seated := b.GamePlayers[name]
+		player.Left = !seated
+		player.Winner = winners[name]
+		player.Marks = (&BingoSheet{Sheet: player.Player_Sheet, dealtAt: dealtAt[name]}).marks(draws)
+		report.Players = append(report.Players, *player)
+	}
+	sort.Slice(report.Players, func(i, j int) bool {
+		return report.Players[i].Player_Name < report.Players[j].Player_Name
+	})
+	return report, nil
+}
+
+func (report *GameReport) summary() GameSummary {
+	players := 0
+	for _, player := range report.Players {
+		if !player.Left {
+			players++
+		}
+	}
+	return GameSummary{Archive_Id: report.Archive_Id,
+		Session_Id: report.Session_Id,
+		Started:    report.Started,
+		Ended:      report.Ended,
+		Players:    players,
+		Draws:      len(report.Draws),
+		Winners:    report.Winners}
+}
+
+// ListHistory lists the archived games the bearer token owned, newest
+// first. The session_id and player query parameters narrow the list
+// down.
+func ListHistory(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		writeAPIError(w, NewProtocolError(ERR_FORBIDDEN, "listing the history needs a host token"))
+		return
+	}
+	if err := limitAPI(r, ""); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	sessionId := r.URL.Query().Get("session_id")
+	playerName := r.URL.Query().Get("player")
+	historyLock.Lock()
+	if err := loadHistory(); err != nil {
+		historyLock.Unlock()
+		writeAPIError(w, NewProtocolError(ERR_INTERNAL, "couldn't read the history: %v", err))
+		return
+	}
+	list := HistoryList{Games: make([]GameSummary, 0, len(historyEntries))}
+	for _, entry := range historyEntries {
+		if entry.ownerToken == "" || !hmac.Equal([]byte(token), []byte(entry.ownerToken)) {
+			continue
+		}
+		if sessionId != "" && entry.summary.Session_Id != sessionId {
+			continue
+		}
+		if playerName != "" && !entry.players[playerName] {
+			continue
+		}
+		list.Games = append(list.Games, entry.summary)
+	}
+	historyLock.Unlock()
+	sort.Slice(list.Games, func(i, j int) bool {
+		if !list.Games[i].Ended.Equal(list.Games[j].Ended) {
+			return list.Games[i].Ended.After(list.Games[j].Ended)
+		}
+		return list.Games[i].Archive_Id < list.Games[j].Archive_Id
+	})
+	writeAPI(w, http.StatusOK, list)
+}
+
+// loadHistory summarizes the archived games of the session store, unless
+// it was done already. Called with historyLock held.
+func loadHistory() error {
+	if historyStore == sessionStore {
+		return nil
+	}
+	history, err := sessionStore.History()
+	if err != nil {
+		return err
+	}
+	historyEntries = make(map[string]*historyEntry, len(history))
+	for _, game := range history {
+		addHistory(game)
+	}
+	historyStore = sessionStore
+	return nil
+}
+
+// addHistory replays an archived game for its summary. Called with
+// historyLock held.
+func addHistory(game *ArchivedGame) {
+	report, err := game.report()
+	if err != nil {
+		log.Println("couldn't replay archived game", game.ArchiveId, err)
+		return
+	}
+	entry := &historyEntry{summary: report.summary(),
+		players:    make(map[string]bool),
+		ownerToken: game.OwnerToken}
+	for _, player := range report.Players {
+		entry.players[player.Player_Name] = true
+	}
+	historyEntries[game.ArchiveId] = entry
+}
+
+// archivedReport returns the report of the archived game of the request
+// for its owner, the token passed as bearer token or host_token query
+// parameter.
+func archivedReport(r *http.Request) (*GameReport, error) {
+	archiveId := mux.Vars(r)["archiveId"]
+	game, err := sessionStore.Archived(archiveId)
+	if err != nil {
+		return nil, NewProtocolError(ERR_INTERNAL, "couldn't read archived game %s: %v", archiveId, err)
+	}
+	if game == nil {
+		return nil, NewProtocolError(ERR_SESSION_NOT_FOUND, "no archived game: %s", archiveId)
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("host_token")
+	}
+	if token == "" {
+		return nil, NewProtocolError(ERR_FORBIDDEN, "the report of %s needs the host token of its owner", archiveId)
+	}
+	if game.OwnerToken == "" || !hmac.Equal([]byte(token), []byte(game.OwnerToken)) {
+		return nil, NewProtocolError(ERR_INVALID_TOKEN, "not the host token of the owner of %s", archiveId)
+	}
+	report, err := game.report()
+	if err != nil {
+		return nil, NewProtocolError(ERR_INTERNAL, "couldn't replay archived game %s: %v", archiveId, err)
+	}
+	return report, nil
+}
+
+// GetHistory returns the report of an archived game.
+func GetHistory(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	report, err := archivedReport(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeAPI(w, http.StatusOK, report)
+}
+
+// ExportHistory exports the report of an archived game in the format of
+// the format query parameter, json by default.
+func ExportHistory(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = EXPORT_JSON
+	}
+	if format != EXPORT_JSON && format != EXPORT_CSV && format != EXPORT_HTML {
+		writeAPIError(w, NewProtocolError(ERR_INVALID_PAYLOAD, "can't export as %q, only as json, csv or html", format))
+		return
+	}
+	report, err := archivedReport(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "bingo-"+report.Archive_Id+"."+format))
+	switch format {
+	case EXPORT_JSON:
+		writeAPI(w, http.StatusOK, report)
+	case EXPORT_CSV:
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		if err := report.writeCSV(csv.NewWriter(w)); err != nil {
+			log.Println(err)
+		}
+	case EXPORT_HTML:
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", "bingo-"+report.Archive_Id+".html"))
+		if err := report.writeHTML(w); err != nil {
+			log.Println(err)
+			http.Error(w, "couldn't render the report", http.StatusInternalServerError)
+		}
+	}
+}
+
+// writeCSV writes the draws, then the players with their cards, one row
+// each. Cards are written column by column, * for the free cells.
+func (report *GameReport) writeCSV(cw *csv.Writer) error {
+	cw.Write([]string{"record", "order", "time", "draw_number", "player_name", "winner", "left", "card"})
+	for _, draw := range report.Draws {
+		cw.Write([]string{"draw", strconv.Itoa(draw.Order), draw.Drawn.UTC().Format(time.RFC3339),
+			strconv.Itoa(draw.Draw_Number), "", "", "", ""})
+	}
+	for _, player := range report.Players {
+		cols := make([]string, 0, len(player.Player_Sheet))
+		for _, col := range player.Player_Sheet {
+			cells := make([]string, 0, len(col))
+			for _, val := range col {
+				if val == -1 {
+					cells = append(cells, "*")
+				} else {
+					cells = append(cells, strconv.Itoa(val))
+				}
+			}
+			cols = append(cols, strings.Join(cells, " "))
+		}
+		cw.Write([]string{"player", "", player.Joined.UTC().Format(time.RFC3339), "", csvText(player.Player_Name),
+			strconv.FormatBool(player.Winner), strconv.FormatBool(player.Left), strings.Join(cols, " / ")})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvText keeps a spreadsheet from reading text a player chose, like a
+// name, as a formula.
+func csvText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// writeHTML renders the printable report, the cards row by row with the
+// drawn cells marked.
+func (report *GameReport) writeHTML(w http.ResponseWriter) error {
+	page, err := readFile("report")
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New("report").Funcs(template.FuncMap{
+		"when": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+		"rows": cardRows,
+	}).Parse(string(page))
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, report); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// cardRows turns a card, stored column by column, into rows of cells.
+func cardRows(player ReportPlayer) [][]reportCell {
+	rows := make([][]reportCell, SHEET_DIM)
+	for i, col := range player.Player_Sheet {
+		for j, val := range col {
+			if j >= SHEET_DIM {
+				break
+			}
+			rows[j] = append(rows[j], reportCell{Number: val, Free: val == -1, Drawn: player.Marks[i][j]})
+		}
+	}
+	return rows
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCSVText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"ann", "ann"},
+		{"", ""},
+		{"=HYPERLINK(\"x\")", "'=HYPERLINK(\"x\")"},
+		{"+1", "'+1"},
+		{"-1+2", "'-1+2"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"a=b", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := csvText(tt.text); got != tt.want {
+			t.Errorf("csvText(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	b, _ := NewBingoGame("csv")
+	b.joinPlayer("=cmd", "t1")
+	b.dealCard("=cmd", card(1, 2))
+	b.drawNumber(1)
+	report, err := (&ArchivedGame{ArchiveId: "csv-1", SessionId: "csv", Events: b.GameLog()}).report()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := report.writeCSV(csv.NewWriter(&out)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), ",'=cmd,") {
+		t.Fatal(out.String())
+	}
+}
+
+func TestListHistory(t *testing.T) {
+	// list returns the archive ids the history lists for query and the
+	// bearer token.
+	list := func(query string, token string) []string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/history?"+query, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		ListHistory(w, r)
+		if token == "" {
+			if w.Code != http.StatusForbidden {
+				t.Fatal("listed the history without a token:", w.Code)
+			}
+			return nil
+		}
+		var history HistoryList
+		if err := json.Unmarshal(w.Body.Bytes(), &history); err != nil {
+			t.Fatal(w.Body.String())
+		}
+		ids := make([]string, 0)
+		for _, game := range history.Games {
+			ids = append(ids, game.Archive_Id)
+		}
+		return ids
+	}
+
+	b, _ := NewBingoGame("lh-one")
+	b.joinPlayer("ann", "t1")
+	b.dealCard("ann", card(1, 2))
+	b.endGame()
+	archiveGame(b, "owner")
+	if one := list("session_id=lh-one", "owner"); len(one) != 1 {
+		t.Fatal(one)
+	}
+	list("session_id=lh-one", "")
+	if other := list("session_id=lh-one", "other"); len(other) != 0 {
+		t.Fatal("listed to another token:", other)
+	}
+
+	// Archived after the history was read.
+	b, _ = NewBingoGame("lh-two")
+	b.joinPlayer("bob", "t1")
+	b.dealCard("bob", card(1, 2))
+	b.endGame()
+	archiveGame(b, "owner")
+	if two := list("session_id=lh-two&player=bob", "owner"); len(two) != 1 {
+		t.Fatal(two)
+	}
+	if none := list("session_id=lh-two&player=ann", "owner"); len(none) != 0 {
+		t.Fatal(none)
+	}
+}
+
+func TestArchiveId(t *testing.T) {
+	ended := time.Unix(1000, 0)
+	one, _ := NewBingoGame("same")
+	one.joinPlayer("ann", "t1")
+	two, _ := NewBingoGame("same")
+	two.joinPlayer("bob", "t2")
+	ids := map[string]bool{
+		archiveId("same", ended, "owner", one.GameLog()): true,
+		archiveId("same", ended, "owner", two.GameLog()): true,
+		archiveId("same", ended, "other", one.GameLog()): true,
+	}
+	if len(ids) != 3 {
+		t.Fatal("games ending in the same second share an archive id:", ids)
+	}
+	if !ids[archiveId("same", ended, "owner", one.GameLog())] {
+		t.Fatal("archiving a game again changed its id")
+	}
+}
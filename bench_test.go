@@ -0,0 +1,178 @@
+/*
+*
+* Fan-out benchmark.
+* Run with go test -run '^$' -bench FanOut to publish draws to sessions
+* of N players and report the time until every player's write pump has
+* written the draw. Players are upgraded over in-memory connections that
+* discard what they are sent, so the benchmark measures the hub and the
+* write pumps rather than the network.
+*
+ */
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//
+// Latency of a draw allowed for each player of the session.
+//
+const (
+	FANOUT_P99_PER_PLAYER = 25 * time.Microsecond
+)
+
+type benchAddr struct{}
+
+func (benchAddr) Network() string { return "bench" }
+func (benchAddr) String() string  { return "bench" }
+
+// benchConn counts the writes of the server and never sends anything.
+type benchConn struct {
+	writes func()
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (c *benchConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *benchConn) Write(p []byte) (int, error) {
+	if c.writes != nil {
+		c.writes()
+	}
+	return len(p), nil
+}
+
+func (c *benchConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *benchConn) LocalAddr() net.Addr                { return benchAddr{} }
+func (c *benchConn) RemoteAddr() net.Addr               { return benchAddr{} }
+func (c *benchConn) SetDeadline(t time.Time) error      { return nil }
+func (c *benchConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *benchConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// benchResponseWriter hands a benchConn to the upgrader.
+type benchResponseWriter struct {
+	*httptest.ResponseRecorder
+	conn *benchConn
+}
+
+func (w *benchResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	brw := bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn))
+	return w.conn, brw, nil
+}
+
+// newBenchClient upgrades a player over a benchConn, calling writes for
+// every write once upgraded.
+func newBenchClient(writes func()) (*Client, error) {
+	r := httptest.NewRequest("GET", "/playersdraw", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if serverConfig.EnableCompression {
+		r.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	}
+	w := &benchResponseWriter{ResponseRecorder: httptest.NewRecorder(),
+		conn: &benchConn{closed: make(chan struct{})}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if serverConfig.EnableCompression {
+		conn.EnableWriteCompression(true)
+		if err := conn.SetCompressionLevel(serverConfig.CompressionLevel); err != nil {
+			return nil, err
+		}
+	}
+	w.conn.writes = writes
+	return NewClient(conn, ROLE_PLAYER), nil
+}
+
+// BenchmarkFanOut publishes draws to sessions of growing size and
+// reports the latency until every player's write pump has written a
+// draw. It fails when the p99 latency is over FANOUT_P99_PER_PLAYER for
+// each player.
+func BenchmarkFanOut(b *testing.B) {
+	for _, players := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprint(players, "-players"), func(b *testing.B) {
+			benchFanOut(b, players)
+		})
+	}
+}
+
+func benchFanOut(b *testing.B, players int) {
+	game, _ := NewBingoGame("bench")
+	hub := NewSessionHub(game)
+	go hub.run()
+	defer close(hub.done)
+
+	var written, target int64
+	delivered := make(chan struct{}, 1)
+	writes := func() {
+		if atomic.AddInt64(&written, 1) == atomic.LoadInt64(&target) {
+			delivered <- struct{}{}
+		}
+	}
+	clients := make([]*Client, players)
+	for i := range clients {
+		c, err := newBenchClient(writes)
+		if err != nil {
+			b.Fatal(err)
+		}
+		clients[i] = c
+		go c.writePump()
+	}
+	defer func() {
+		for _, c := range clients {
+			c.Close(websocket.CloseNormalClosure, "")
+		}
+	}()
+	hub.call(func() {
+		for i, c := range clients {
+			hub.players[fmt.Sprintf("player-%d", i)] = c
+		}
+	})
+	evictions := collectMetrics().Evictions
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	latencies := make([]time.Duration, 0, b.N)
+	for i := 0; i < b.N; i++ {
+		atomic.StoreInt64(&target, atomic.LoadInt64(&written)+int64(players))
+		start := time.Now()
+		hub.call(func() {
+			hub.publish(AUDIENCE_PLAYERS, WebMsgOut{Msg_Type: "draw_number", Draw_Number: i%BOARD_BALLS + 1})
+		})
+		<-delivered
+		latencies = append(latencies, time.Since(start))
+	}
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p50 := latencies[len(latencies)/2]
+	p99 := latencies[len(latencies)*99/100]
+	b.ReportMetric(float64(p50.Microseconds())/1000, "p50-ms")
+	b.ReportMetric(float64(p99.Microseconds())/1000, "p99-ms")
+	if evicted := collectMetrics().Evictions - evictions; evicted > 0 {
+		b.Errorf("%d players evicted", evicted)
+	}
+	if bound := time.Duration(players) * FANOUT_P99_PER_PLAYER; p99 > bound {
+		b.Errorf("p99 latency of a draw to %d players is %v, over %v", players, p99, bound)
+	}
+}
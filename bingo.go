@@ -8,6 +8,7 @@ package  main
 
 import  (
 	"log"
+	"flag"
 	"fmt"
 	"sync"
 	"math/rand"
@@ -18,7 +19,6 @@ import  (
 	"github.com/gorilla/websocket"
 	"io/ioutil"
 	"net/http"
-	"strings"
 )
 
 type StatusResp struct {
@@ -29,11 +29,6 @@ type PongResp struct {
 	Msg_Type string   `json:"msg_type"`
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
 type Route struct {
 	Name        string
 	Method      string
@@ -83,6 +78,132 @@ var routes = Routes {
 		"/playersdraw",
 		PlayersDraw,
 	},
+	Route{
+		"Spectate",
+		"GET",
+		"/spectate",
+		Spectate,
+	},
+	Route{
+		"Board",
+		"GET",
+		"/board/{sessId}",
+		Board,
+	},
+	Route{
+		"SessionEvents",
+		"GET",
+		"/sessions/{sessId}/events",
+		SessionEvents,
+	},
+	Route{
+		"SessionCommands",
+		"POST",
+		"/sessions/{sessId}/commands",
+		SessionCommands,
+	},
+	Route{
+		"Ticket",
+		"GET",
+		"/ticket",
+		Ticket,
+	},
+	Route{
+		"Metrics",
+		"GET",
+		"/metrics",
+		Metrics,
+	},
+	Route{
+		"ListSessions",
+		"GET",
+		"/api/sessions",
+		ListSessions,
+	},
+	Route{
+		"CreateSession",
+		"POST",
+		"/api/sessions",
+		CreateSession,
+	},
+	Route{
+		"GetSession",
+		"GET",
+		"/api/sessions/{sessId}",
+		GetSession,
+	},
+	Route{
+		"EndSession",
+		"DELETE",
+		"/api/sessions/{sessId}",
+		EndSession,
+	},
+	Route{
+		"ListPlayers",
+		"GET",
+		"/api/sessions/{sessId}/players",
+		ListPlayers,
+	},
+	Route{
+		"ListDraws",
+		"GET",
+		"/api/sessions/{sessId}/draws",
+		ListDraws,
+	},
+	Route{
+		"Draw",
+		"POST",
+		"/api/sessions/{sessId}/draws",
+		Draw,
+	},
+	Route{
+		"AddWebhook",
+		"POST",
+		"/api/sessions/{sessId}/webhooks",
+		AddWebhook,
+	},
+	Route{
+		"RemoveWebhook",
+		"DELETE",
+		"/api/sessions/{sessId}/webhooks/{hookId}",
+		RemoveWebhook,
+	},
+	Route{
+		"ListHistory",
+		"GET",
+		"/api/history",
+		ListHistory,
+	},
+	Route{
+		"GetHistory",
+		"GET",
+		"/api/history/{archiveId}",
+		GetHistory,
+	},
+	Route{
+		"ExportHistory",
+		"GET",
+		"/api/history/{archiveId}/export",
+		ExportHistory,
+	},
+	Route{
+		"WebhookTestDeliveries",
+		"GET",
+		"/webhooks/test",
+		WebhookTestDeliveries,
+	},
+	Route{
+		"OpenAPIDoc",
+		"GET",
+		"/openapi.json",
+		OpenAPIDoc,
+	},
+	Route{
+		"WebsocketSchemas",
+		"GET",
+		"/schemas/websocket.json",
+		WebsocketSchemas,
+	},
 }
 
 //
@@ -99,6 +220,13 @@ type BingoSheet struct {
 	SheetId      int
 	Sheet [][]int
 	Conn         *websocket.Conn
+	Connected    bool
+	// Connected, idle or disconnected.
+	Presence     string
+	disconnectedAt time.Time
+	resumeToken  string
+	// Numbers drawn before the sheet was dealt, which don't count on it.
+	dealtAt      int
 	totalMatchNeeded int
 	drawMatchCount  int
 	oneColMatch  bool
@@ -117,26 +245,26 @@ type BingoGame struct {
 	winnerOneRow  bool
 	winnerOneDiagonal  bool
 	winnerFullHouse  bool
-
+	winners []string
+	ended bool
+	// Every change of the game, in order.
+	gameLog []GameEvent
+	hub *SessionHub
 }
 
 type BingoSessions struct {
 	activeSessions  map[string]*BingoGame
+	endedSessions   map[string]bool
 }
 
 var  games *BingoSessions
 var  gamesLock sync.Mutex
 
 func NewBingoGame(gameId string) (*BingoGame, error) {
-	bGame := BingoGame{ GameId: gameId,
-			    GameLink: "http://192.168.11.23/players/" + gameId,
-	                    GamePlayers: make(map[string]*BingoSheet),
-			    draws: make([]int, 100), 
-		            drawCount: 0,
-			    winnerOneCol: false,
-			    winnerOneRow: false,
-			    winnerOneDiagonal: false,
-			    winnerFullHouse: false, }
+	bGame := BingoGame{}
+	bGame.record(GameEvent{Type: GAME_EVENT_CREATED,
+			       GameId: gameId,
+			       GameLink: "http://192.168.11.23/players/" + gameId, })
 	return &bGame,  nil
 }
 
@@ -149,34 +277,16 @@ func NewBingoSheet() (*BingoSheet, error) {
 	return &bingoSheet, nil
 }
 
-func  FindBingoSession(gameId string) (*BingoGame, error) {
-	if gameId == "" {
-		return nil, fmt.Errorf("couldn't find bingo session for nil gameId.")
-	}
-
-	if b, ok := games.activeSessions[gameId]; ok {
-		return  b, nil
-	}
-
-	return nil, fmt.Errorf("couldn't find bingo sesssion, probably session for gameId is not active %v", gameId)
-}
-
-func (b *BingoGame) AddPlayer(player string) (*BingoSheet, error) {
-	if player == "" {
-		return nil, fmt.Errorf("couldn't add the nil player", player)
-	}
-
+// sessionNotFound reports a lookup of a session that is not active,
+// telling finished games apart from unknown ones.
+func sessionNotFound(gameId string) error {
 	gamesLock.Lock()
-	defer gamesLock.Unlock()
-
-	aSheet, _ := NewBingoSheet()
-	aSheet.populateSheet()
-
-	b.GamePlayers[player] = aSheet
-
-	log.Printf("%v: added new player", b.GameId, player)
-
-	return aSheet, nil
+	ended := games.endedSessions[gameId]
+	gamesLock.Unlock()
+	if ended {
+		return NewProtocolError(ERR_GAME_OVER, "game is over for session: %s", gameId)
+	}
+	return NewProtocolError(ERR_SESSION_NOT_FOUND, "no session found: %s", gameId)
 }
 
 func (s *BingoSheet) populateSheet() {
@@ -192,8 +302,7 @@ func (s *BingoSheet) populateSheet() {
 			s.totalMatchNeeded -= 1
 		} else {
 			// Wildcard the random location
-			genIn <- 5
-			r := <- genOut
+			r := randIntn(5)
 			if r != 0 {
 				s.Sheet[i][r] = -1
 				s.totalMatchNeeded -= 1
@@ -222,8 +331,7 @@ func uniqRandNumber(aCol []int, idx int) int {
 	min := idx * 15
 	max := (idx+1) * 15
 	for {
-		genIn <- max - min
-		r := <- genOut + min
+		r := randIntn(max - min) + min
 		if r == 0  {
 			continue
 		}
@@ -242,45 +350,36 @@ func uniqRandNumber(aCol []int, idx int) int {
 }
 
 
+// DrawUniqRandNumber draws one of the numbers not drawn yet, 0 once all
+// of them are.
 func DrawUniqRandNumber(draws []int) int {
-	dCount := 0
-	for {
-		if dCount >= 75 {
-			break
-		}
-		genIn <- 75
-		r := <- genOut
-		if r == 0  {
-			continue
-		}
-		duplicate := false
-		for _, v := range draws {
-			if v == r {
-				duplicate = true
-				break
-			}
-		}
-		if  duplicate {
-			dCount += 1
-			continue
+	drawn := make(map[int]bool, len(draws))
+	for _, v := range draws {
+		drawn[v] = true
+	}
+	left := make([]int, 0, 75)
+	for n := 1; n < 75; n++ {
+		if !drawn[n] {
+			left = append(left, n)
 		}
-		return r
 	}
-	return 0
+	if len(left) == 0 {
+		return 0
+	}
+	return left[randIntn(len(left))]
 }
 
 var gotWinner chan string
 
 func (b *BingoGame) Play(dChan chan int) {
-	for b.drawCount = 0; b.drawCount < 75; b.drawCount++ {
-		b.draws[b.drawCount] = DrawUniqRandNumber(b.draws)
-		dChan <- b.draws[b.drawCount]
-		for player := range b.GamePlayers {
-			if b.GamePlayers[player].findMatch(b.draws[b.drawCount])  {
-				gotWinner <- player
-				close(gotWinner)
-				return
-			}
+	for b.drawCount < 75 {
+		dNum := DrawUniqRandNumber(b.draws)
+		winners := b.drawNumber(dNum)
+		dChan <- dNum
+		if len(winners) > 0 {
+			gotWinner <- winners[0]
+			close(gotWinner)
+			return
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
@@ -298,7 +397,7 @@ func Players(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionId := vars["sessId"]
 	fmt.Println("SessionId:", sessionId)
-	if _,ok := games.activeSessions[sessionId]; !ok {
+	if !sessionActive(sessionId) {
 		fmt.Println("No active session:", sessionId)
 		http.NotFound(w, r)
 		return
@@ -321,366 +420,39 @@ func Status(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// WebSocket In&Out structs.
-type WebMsgIn struct {
-	MsgType int
-	Msg []byte
-	Conn  *websocket.Conn
-}
-
+// WebSocket Out structs.
 type  WebMsgOut struct {
 	Msg_Type      string   `json:"msg_type"`
 	Player_Name   string   `json:"new_player"`
 	Draw_Number   int      `json:"draw_number"`
 	Player_Sheet  [][]int  `json:"player_sheet"`
-	Match         bool     `json:"match"`
-	Col           int      `json:"col"`
-	Row           int      `json:"row"`
 	Winner        bool     `json:"winner"`
+	Seq           int64    `json:"seq,omitempty"`
+	Presence      string   `json:"presence,omitempty"`
 }
 
-type DrawnNumRec struct {
-	DrawnNum int
-	Match    bool
-	Col      int
-	Row      int
-	Conn	 *websocket.Conn
-	WinnerName string
-}
-
-// Admin reads websocket messages from admin client.
-var adminWebInChan chan *WebMsgIn
-
-// Admin reads players name from each players client.
-// Each players sends player names to admin.
-var players2AdminChan chan string
-
 func GameLink(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil) // error ignored for sake of simplicity
+	client, err := upgradeClient(w, r, ROLE_ADMIN)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	fmt.Println("websocket upgraded..")
 
-	go func () {
-		for {
-			msgType, msg, err := conn.ReadMessage()
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			fmt.Println("GameLink => Msg:", string(msg))
-			adminWebInChan <- &WebMsgIn { MsgType: msgType, Msg: msg, Conn: conn, }
-		}
-	}()
-
-	go func() {
-		var msgType int
-		var msg []byte
-		var adminConn *websocket.Conn
-		var playerName string
-		var sessionId string
-		for {
-			select {
-				// Read message from browser
-			case webMsgIn := <- adminWebInChan:
-				msgType = webMsgIn.MsgType
-				msg = webMsgIn.Msg
-				adminConn = webMsgIn.Conn
-			        if string(msg) == "ping" {
-					pongResp := PongResp{ Msg_Type: "pong", }
-					jsonPong, err := json.Marshal(pongResp)
-					w.Header().Set("Content-Type", "application/json")
-					fmt.Println("GameLink => Reply: pong")
-					if err = adminConn.WriteMessage(msgType, []byte(jsonPong)); err != nil {
-						log.Println(err)
-						return
-					}
-					continue
-				}
-				fmt.Println("GameLink => WebMsgIn:", string(msg))
-				sIndex := strings.Index(string(msg), "/")
-				status := string(msg)[0:sIndex];
-				sessionId = string(msg)[sIndex+1:]
-				log.Println("cmd:", status)
-				log.Println("SessionId:", sessionId)
-				if status == "status" {
-					if _, ok := games.activeSessions[sessionId]; !ok {
-					    gameLink := "http://192.168.11.23/players/" + sessionId
-					    //gameLink := "http://71.202.98.110/players/" + sessionId
-					    games.activeSessions[sessionId],_ = NewBingoGame(sessionId)
-					    games.activeSessions[sessionId].GameLink = gameLink
-					    log.Println("New session created:", sessionId)
-				        }
-				} else {
-					if _, ok := games.activeSessions[sessionId]; !ok {
-						log.Println("No session found:", sessionId)
-						return
-					}
-					log.Println("Draw a number for the session:", sessionId)
-					msg = []byte("drawnumber")
-				}
-			case playerName = <- players2AdminChan:
-				fmt.Println("Admin: Received meaasge ==> New Player is being added:", playerName)
-				msg = []byte("new_player")
-				msgType = 1 // TextMessage
-			}
-			var webMsgOut WebMsgOut
-			if string(msg) == "gamelink" && len(games.activeSessions) > 0 {
-				var gameLink string
-				for sId, v := range games.activeSessions {
-					gameLink = v.GameLink
-					sessionId = sId
-				}
-				// Print the message to the console
-				fmt.Printf("%s is being sent: %s\n", adminConn.RemoteAddr(), gameLink)
-
-				// Write message back to browser
-				if err = adminConn.WriteMessage(msgType, []byte(gameLink)); err != nil {
-					log.Println(err)
-					return
-				}
-			} else if string(msg) == "new_player"  && len(games.activeSessions) > 0 {
-				// Print the message to the console
-				fmt.Printf("Admin: update for new player %s is being sent: %s\n", conn.RemoteAddr(), playerName)
-				webMsgOut.Msg_Type = string(msg)
-				webMsgOut.Player_Name = playerName
-				webMsgOut.Winner = false
-				jsonPlayer, err := json.Marshal(webMsgOut)
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-				w.Header().Set("Content-Type", "application/json")
-
-				// Write message back to browser
-				if err = adminConn.WriteMessage(msgType, []byte(jsonPlayer)); err != nil {
-					log.Println(err)
-					return
-				}
-			} else if string(msg) == "drawnumber"  && len(games.activeSessions) > 0 {
-				bingoSession := games.activeSessions[sessionId]
-				dNum := DrawUniqRandNumber(bingoSession.draws)
-				if dNum == 0 {
-					log.Println("DrawNumber ==> 0")
-				} else {
-					bingoSession.draws[bingoSession.drawCount] = dNum
-					bingoSession.drawCount += 1
-				}
-				if bingoSession.drawCount == 75 {
-					log.Println("DrawNumber's list is full. We should already have a winner.")
-					sort.Ints(bingoSession.draws)
-					log.Println(bingoSession.draws)
-				}
-				w.Header().Set("Content-Type", "application/json")
-				webMsgOut.Msg_Type = "draw_number"
-				webMsgOut.Draw_Number =  dNum
-				jsonNumber, err := json.Marshal(webMsgOut)
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-
-				// Print the message to the console
-				fmt.Printf("%s is being sent: %d\n", adminConn.RemoteAddr(), dNum)
-
-				// Write message back to browser
-				if err = adminConn.WriteMessage(msgType, []byte(jsonNumber)); err != nil {
-					log.Println(err)
-					return
-				}
-				winnerFound := false
-				winnerName  := ""
-				xPlayers := make([]string, 0)
-				for player,playerSheet := range bingoSession.GamePlayers {
-					log.Printf("sending drawn number: %d ==> player: %s Addr: %s\n", dNum, player, playerSheet.Conn.RemoteAddr())
-					match := false
-					col := 0
-					row := 0
-					for  j, xCol := range playerSheet.Sheet {
-						for i, rVal := range xCol {
-							if rVal == dNum {
-								match = true
-								col = j
-								row = i
-								break
-							}
-							if match {
-								break
-							}
-						}
-					}
-					if match {
-					    log.Printf("match found: %d ==> player: %s, col: %d row: %d\n", dNum, player, col, row)
-					    if playerSheet.findMatch(dNum)  {
-							winnerFound = true
-							winnerName = player
-							fmt.Printf("Admin: found winner: %s and is being sent: %s\n", conn.RemoteAddr(), player)
-							webMsgOut.Msg_Type = "winner"
-							webMsgOut.Player_Name = player
-							webMsgOut.Winner = true
-							jsonPlayer, err := json.Marshal(webMsgOut)
-							if err != nil {
-								fmt.Println(err)
-								return
-							}
-							w.Header().Set("Content-Type", "application/json")
-
-							// Write message back to browser
-							if err = adminConn.WriteMessage(msgType, []byte(jsonPlayer)); err != nil {
-								log.Println(err)
-								return
-							}
-					    }
-					}
-					drawnNumChan <- &DrawnNumRec{ DrawnNum: dNum,
-								      Match: match,
-								      Col: col,
-								      Row: row,
-								      Conn: playerSheet.Conn,
-							              WinnerName: winnerName, }
-					if !winnerFound {
-						xPlayers = append(xPlayers, player)
-					}
-				}
-			        if winnerFound {
-					for _, player := range xPlayers {
-						drawnNumChan <- &DrawnNumRec{ DrawnNum: 0,
-									      Match: false,
-									      Col: 0,
-									      Row: 0,
-									      Conn: bingoSession.GamePlayers[player].Conn,
-									      WinnerName: winnerName, }
-					}
-					log.Println("GAME OVER ==> WINNER:", winnerName)
-					log.Println("Killing the session", sessionId)
-				        delete(games.activeSessions, sessionId)
-			        }
-			}
-		}
-	}()
+	go client.writePump()
+	go client.readPump()
 }
 
-var playerWebInChan chan *WebMsgIn
-var drawnNumChan chan *DrawnNumRec
-
 func PlayersDraw(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil) // error ignored for sake of simplicity
+	client, err := upgradeClient(w, r, ROLE_PLAYER)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	log.Println("Upgrading to websocket for ", r.URL.Path, " for remote client: ", conn.RemoteAddr())
-
-	go func () {
-		for {
-			log.Println("Reading request from websocket:", conn.RemoteAddr())
-			// Read message from browser
-			msgType, msg, err := conn.ReadMessage()
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			log.Println("PlayersDraw Msg:", string(msg))
-			if string(msg) == "ping" {
-				playerWebInChan <- &WebMsgIn{ MsgType: msgType, Msg: msg, Conn: conn, }
-			} else {
-				if !strings.Contains(string(msg), "add/") {
-					fmt.Println("invalid request ..")
-					return
-				}
-				playerWebInChan <- &WebMsgIn{ MsgType: msgType, Msg: msg, Conn: conn, }
-			}
-		}
-	}()
-
-	go func() {
-		msgType := 1
-		var snId, playerName string
-		var webMsgOut WebMsgOut
-		for {
-			select {
-			case webMsgIn := <- playerWebInChan:
-				if string(webMsgIn.Msg) == "ping" {
-					playerConn := webMsgIn.Conn
-					pongResp := PongResp{ Msg_Type: "pong", }
-					jsonPong, err := json.Marshal(pongResp)
-					w.Header().Set("Content-Type", "application/json")
-					if err = playerConn.WriteMessage(msgType, []byte(jsonPong)); err != nil {
-						log.Println(err)
-						return
-					}
-					continue
-				}
-				sIndex := strings.Index(string(webMsgIn.Msg), "/")
-				subMsg := string(webMsgIn.Msg)[sIndex+1:]
-				pIndex := strings.Index(subMsg, "/")
-				snId = subMsg[: pIndex]
-				playerName = subMsg[pIndex+1:]
-				fmt.Println("WebMsgIn SessionId:", snId)
-				fmt.Println("WebMsgIn PlayerName:", playerName)
-				if _, ok := games.activeSessions[snId]; !ok {
-					fmt.Println("Invalid SessonId got:", snId)
-					return
-				}
-				// Adding new player
-				playerConn := webMsgIn.Conn
-				if _, ok := games.activeSessions[snId].GamePlayers[playerName]; !ok {
-					games.activeSessions[snId].GamePlayers[playerName],_ = NewBingoSheet()
-					games.activeSessions[snId].GamePlayers[playerName].Conn = playerConn
-					games.activeSessions[snId].GamePlayers[playerName].populateSheet()
-				} else {  // update the existing players sheet.
-					games.activeSessions[snId].GamePlayers[playerName].SheetId++
-					games.activeSessions[snId].GamePlayers[playerName].Sheet = getASheet()
-					games.activeSessions[snId].GamePlayers[playerName].populateSheet()
-				}
-				webMsgOut.Msg_Type = "player_sheet"
-				webMsgOut.Player_Sheet = games.activeSessions[snId].GamePlayers[playerName].Sheet
-				fmt.Printf("Reply to: %s is being sent: %d\n", playerConn.RemoteAddr(), webMsgOut.Player_Sheet)
-				jsonObj, err := json.Marshal(webMsgOut)
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-				w.Header().Set("Content-Type", "application/json")
+	log.Println("Upgrading to websocket for ", r.URL.Path, " for remote client: ", client.conn.RemoteAddr())
 
-				// Write message back to browser
-				if err = playerConn.WriteMessage(msgType, []byte(jsonObj)); err != nil {
-					fmt.Println(err)
-					return
-				}
-				players2AdminChan <- playerName
-			case drawnNumRec := <- drawnNumChan:
-					webMsgOut.Msg_Type = "draw_number"
-					webMsgOut.Draw_Number = drawnNumRec.DrawnNum
-					webMsgOut.Match = drawnNumRec.Match
-					webMsgOut.Col = drawnNumRec.Col
-					webMsgOut.Row = drawnNumRec.Row
-					playerConn := drawnNumRec.Conn
-					if drawnNumRec.WinnerName == "" {
-						webMsgOut.Winner = false
-					} else {
-						webMsgOut.Winner = true
-						webMsgOut.Player_Name = drawnNumRec.WinnerName
-					}
-					fmt.Printf("%s is being sent: %d\n", playerConn.RemoteAddr(), webMsgOut.Draw_Number)
-
-					jsonObj, err := json.Marshal(webMsgOut)
-					if err != nil {
-						fmt.Println(err)
-						return
-					}
-					w.Header().Set("Content-Type", "application/json")
-
-					// Write message back to browser
-					if err = playerConn.WriteMessage(msgType, []byte(jsonObj)); err != nil {
-						fmt.Println(err)
-						return
-					}
-			}
-		}
-	}()
+	go client.writePump()
+	go client.readPump()
 }
 
 func readFile(title string) ([]byte, error) {
@@ -703,24 +475,29 @@ func getASheet() [][]int {
 
 func init() {
 
-	games = &BingoSessions{activeSessions: make(map[string]*BingoGame), }
-
-	adminWebInChan = make(chan *WebMsgIn)
-	players2AdminChan = make(chan string, 1)
-
-	playerWebInChan = make(chan *WebMsgIn)
-	drawnNumChan = make(chan *DrawnNumRec)
+	games = &BingoSessions{activeSessions: make(map[string]*BingoGame),
+			       endedSessions: make(map[string]bool), }
 
 	gotWinner = make(chan string, 1)
-	genIn = make(chan int)
-	genOut = make(chan int)
 }
 
 func main() {
-	go generateRandomNumber()
-
+	serverConfig.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+	upgrader = NewUpgrader(serverConfig)
+	if err := startCluster(serverConfig); err != nil {
+		log.Fatal(err)
+	}
+	if err := startStore(serverConfig); err != nil {
+		log.Fatal(err)
+	}
+	if err := startWebhooks(serverConfig); err != nil {
+		log.Fatal(err)
+	}
 	router := NewRouter()
-	log.Fatal(http.ListenAndServe("192.168.11.23:80", router))
+	if err := serve(router); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func checkForWinner(bGame *BingoGame) {
@@ -742,8 +519,6 @@ func checkForWinner(bGame *BingoGame) {
 		}
 	}
 
-	genIn <- -1
-
 	if ok := TestWinner(bGame, winner); ok {
 		log.Println("Test PASS... winner is",  winner)
 		return
@@ -751,37 +526,15 @@ func checkForWinner(bGame *BingoGame) {
 	log.Println("Test FAIL... winner is",  winner)
 }
 
-var genIn, genOut chan int
+// Source of the cards and draws, shared by the hubs of every session.
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+var randomLock sync.Mutex
 
-func generateRandomNumber() {
-	runGenRand := func(c chan int, id int) {
-		rand.Seed(time.Now().Unix() + int64(id*9999999))
-		for g := range  genIn {
-			if g == -1 {
-				c <- g
-				return 
-			}
-			c <- rand.Intn(g)
-		}
-	}
-	c1 := make(chan int)
-	go runGenRand(c1, 1) 
-	c2 := make(chan int)
-	go runGenRand(c2, 2) 
-	c3 := make(chan int)
-	go runGenRand(c3, 3) 
-	var x int 
-	for {
-		select {
-			case x = <- c1:
-			case x = <- c2:
-			case x = <- c3:
-		}
-		if x == -1 {
-			return
-		}
-		genOut <- x
-	}
+// randIntn returns a random number in [0, n).
+func randIntn(n int) int {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return random.Intn(n)
 }
 
 func matchesIn(draws []int, val int) bool {
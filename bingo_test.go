@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSessionNotFound(t *testing.T) {
+	gamesLock.Lock()
+	games.endedSessions["nf-ended"] = true
+	gamesLock.Unlock()
+	if code := asProtocolError(sessionNotFound("nf-ended")).Code; code != ERR_GAME_OVER {
+		t.Fatal(code)
+	}
+	if code := asProtocolError(sessionNotFound("nf-unknown")).Code; code != ERR_SESSION_NOT_FOUND {
+		t.Fatal(code)
+	}
+
+	// Sessions end while clients look them up.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			gamesLock.Lock()
+			games.endedSessions[fmt.Sprint("nf-", i)] = true
+			gamesLock.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			sessionNotFound(fmt.Sprint("nf-", i))
+		}
+	}()
+	wg.Wait()
+}
+
+func TestNewCardConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for g := 0; g < 8; g++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := checkCard(newCard()); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		// Draws from the same source as the cards.
+		go func() {
+			defer wg.Done()
+			draws := make([]int, 0, 75)
+			drawn := make(map[int]bool)
+			for {
+				draw := DrawUniqRandNumber(draws)
+				if draw == 0 {
+					if len(draws) != 74 {
+						errs <- fmt.Errorf("no number left after %d draws", len(draws))
+					}
+					return
+				}
+				if draw < 1 || draw > 74 || drawn[draw] {
+					errs <- fmt.Errorf("drew %d", draw)
+					return
+				}
+				draws = append(draws, draw)
+				drawn[draw] = true
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// checkCard reports a number of a card outside the range of its column,
+// or drawn twice in it.
+func checkCard(sheet [][]int) error {
+	for i, col := range sheet {
+		seen := make(map[int]bool)
+		for _, val := range col {
+			if val == -1 {
+				continue
+			}
+			if val < i*15 || val >= (i+1)*15 || val == 0 || seen[val] {
+				return fmt.Errorf("%d in column %d of %v", val, i, sheet)
+			}
+			seen[val] = true
+		}
+	}
+	if sheet[2][2] != -1 {
+		return fmt.Errorf("no free center in %v", sheet)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+/*
+*
+* Broadcast fan-out.
+* A message sent to many clients is marshalled once and wrapped in a
+* websocket.PreparedMessage, which frames and compresses it once per
+* negotiated compression instead of once per connection.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+)
+
+// NewBroadcast marshals v into a message that can be queued for any
+// number of clients.
+func NewBroadcast(v interface{}) (*Outbound, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := websocket.NewPreparedMessage(websocket.TextMessage, data)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbound{data: data, msgType: messageType(data), prepared: prepared}, nil
+}
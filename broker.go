@@ -0,0 +1,173 @@
+/*
+*
+* Message broker.
+* Instances of the server exchange session commands and events through
+* a Broker. The in-memory broker serves a single instance, the redis
+* broker lets several instances share sessions.
+*
+ */
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//
+// Messages buffered per subscription.
+//
+const (
+	BROKER_QUEUE = 1024
+)
+
+type Broker interface {
+	Publish(topic string, msg []byte) error
+	Subscribe(topic string) (Subscription, error)
+	// Claim makes instance the owner of key for ttl unless another
+	// instance owns it already, and returns the owner. The owner renews
+	// its claim by claiming again.
+	Claim(key string, instance string, ttl time.Duration) (string, error)
+	// Owner returns the instance owning key, empty when there is none.
+	Owner(key string) (string, error)
+	// Release drops the claim of instance on key.
+	Release(key string, instance string) error
+}
+
+type Subscription interface {
+	// Messages is closed once the subscription ends.
+	Messages() <-chan []byte
+	Close() error
+}
+
+// NewBroker connects to the broker at addr, "memory" or
+// redis://[:password@]host:port.
+func NewBroker(addr string) (Broker, error) {
+	if addr == "" || addr == "memory" {
+		return NewMemoryBroker(), nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported broker: %s", addr)
+	}
+	password, _ := u.User.Password()
+	return DialRedisBroker(u.Host, password)
+}
+
+type memoryClaim struct {
+	owner   string
+	expires time.Time
+}
+
+type MemoryBroker struct {
+	mu     sync.Mutex
+	topics map[string]map[*memorySubscription]bool
+	claims map[string]memoryClaim
+}
+
+type memorySubscription struct {
+	broker   *MemoryBroker
+	topic    string
+	messages chan []byte
+	closed   chan struct{}
+	once     sync.Once
+	// Held by publishers while sending, messages is only closed once
+	// none is left.
+	sending sync.RWMutex
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{topics: make(map[string]map[*memorySubscription]bool),
+		claims: make(map[string]memoryClaim)}
+}
+
+func (b *MemoryBroker) Publish(topic string, msg []byte) error {
+	b.mu.Lock()
+	subs := make([]*memorySubscription, 0, len(b.topics[topic]))
+	for s := range b.topics[topic] {
+		subs = append(subs, s)
+	}
+	b.mu.Unlock()
+
+	for _, s := range subs {
+		s.send(msg)
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe(topic string) (Subscription, error) {
+	s := &memorySubscription{broker: b, topic: topic,
+		messages: make(chan []byte, BROKER_QUEUE),
+		closed:   make(chan struct{})}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.topics[topic] == nil {
+		b.topics[topic] = make(map[*memorySubscription]bool)
+	}
+	b.topics[topic][s] = true
+	return s, nil
+}
+
+func (b *MemoryBroker) Claim(key string, instance string, ttl time.Duration) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if claim, ok := b.claims[key]; ok && claim.owner != instance && now.Before(claim.expires) {
+		return claim.owner, nil
+	}
+	b.claims[key] = memoryClaim{owner: instance, expires: now.Add(ttl)}
+	return instance, nil
+}
+
+func (b *MemoryBroker) Owner(key string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if claim, ok := b.claims[key]; ok && time.Now().Before(claim.expires) {
+		return claim.owner, nil
+	}
+	return "", nil
+}
+
+func (b *MemoryBroker) Release(key string, instance string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.claims[key].owner == instance {
+		delete(b.claims, key)
+	}
+	return nil
+}
+
+func (s *memorySubscription) send(msg []byte) {
+	s.sending.RLock()
+	defer s.sending.RUnlock()
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	select {
+	case s.messages <- msg:
+	case <-s.closed:
+	}
+}
+
+func (s *memorySubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *memorySubscription) Close() error {
+	s.once.Do(func() {
+		s.broker.mu.Lock()
+		delete(s.broker.topics[s.topic], s)
+		s.broker.mu.Unlock()
+		close(s.closed)
+		s.sending.Lock()
+		close(s.messages)
+		s.sending.Unlock()
+	})
+	return nil
+}
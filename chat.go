@@ -0,0 +1,244 @@
+/*
+*
+* Session chat.
+* Players and hosts chat within their session hub. Messages are length
+* limited, rate limited per connection and run through the profanity
+* filter. The last messages are kept so joining players can catch up.
+* Hosts can mute players, delete messages and slow the chat down.
+* Chat isn't numbered with the session events, it has its own history.
+*
+ */
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//
+// Name shown for messages of the hosts.
+//
+const (
+	CHAT_HOST_NAME = "host"
+)
+
+// Payload of chat command.
+type ChatPayload struct {
+	SessionId string `json:"session_id"`
+	Text      string `json:"text"`
+}
+
+// Payload of mute command.
+type MutePayload struct {
+	SessionId  string `json:"session_id"`
+	PlayerName string `json:"player_name"`
+	Muted      bool   `json:"muted"`
+}
+
+// Payload of delete_message command.
+type DeleteMessagePayload struct {
+	SessionId string `json:"session_id"`
+	MessageId int64  `json:"message_id"`
+}
+
+// Payload of slow_mode command, zero seconds turns it off.
+type SlowModePayload struct {
+	SessionId string `json:"session_id"`
+	Seconds   int    `json:"seconds"`
+}
+
+type ChatMessage struct {
+	Msg_Type    string `json:"msg_type"`
+	Message_Id  int64  `json:"message_id"`
+	Player_Name string `json:"player_name"`
+	Host        bool   `json:"host"`
+	Text        string `json:"text"`
+	Sent        int64  `json:"sent"`
+}
+
+type ChatHistory struct {
+	Msg_Type string        `json:"msg_type"`
+	Messages []ChatMessage `json:"messages"`
+	// Seconds a player has to wait between messages, zero when off.
+	Slow_Mode int  `json:"slow_mode"`
+	Muted     bool `json:"muted"`
+}
+
+// Moderation changes announced in the session.
+type ChatNotice struct {
+	Msg_Type    string `json:"msg_type"`
+	Message_Id  int64  `json:"message_id,omitempty"`
+	Player_Name string `json:"player_name,omitempty"`
+	Muted       bool   `json:"muted,omitempty"`
+	Slow_Mode   int    `json:"slow_mode,omitempty"`
+}
+
+// Chat state of a session, only used by its hub.
+type ChatRoom struct {
+	history  []ChatMessage
+	lastId   int64
+	muted    map[string]bool
+	slowMode time.Duration
+	lastSent map[string]time.Time
+}
+
+var chatFilter *regexp.Regexp
+var chatFilterOnce sync.Once
+
+func NewChatRoom() *ChatRoom {
+	return &ChatRoom{history: make([]ChatMessage, 0),
+		muted:    make(map[string]bool),
+		lastSent: make(map[string]time.Time)}
+}
+
+// filterChat masks the words of the blocklist.
+func filterChat(text string) string {
+	chatFilterOnce.Do(func() {
+		words := make([]string, 0)
+		for _, word := range serverConfig.ChatBlocklist {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+		if len(words) > 0 {
+			chatFilter = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+		}
+	})
+	if chatFilter == nil {
+		return text
+	}
+	return chatFilter.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+}
+
+// chat relays a message of c to the admins and players of the session.
+func (h *SessionHub) chat(c *Client, cmd *Command) {
+	var payload ChatPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	text := strings.TrimSpace(payload.Text)
+	if text == "" || utf8.RuneCountInString(text) > serverConfig.ChatMaxLength {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "chat messages are 1 to %d characters", serverConfig.ChatMaxLength))
+		return
+	}
+
+	room := h.chatRoom
+	name := CHAT_HOST_NAME
+	host := c.role == ROLE_ADMIN
+	if !host {
+		name = h.playerNames[c]
+		if name == "" {
+			sendError(c, cmd, NewProtocolError(ERR_INVALID_COMMAND, "join the session before chatting"))
+			return
+		}
+		if room.muted[name] {
+			sendError(c, cmd, NewProtocolError(ERR_MUTED, "you are muted in session: %s", h.game.GameId))
+			return
+		}
+		if wait := room.slowMode - time.Since(room.lastSent[name]); wait > 0 {
+			sendError(c, cmd, NewProtocolError(ERR_SLOW_MODE, "slow mode is on, wait %d more seconds", int(wait.Seconds())+1))
+			return
+		}
+		room.lastSent[name] = time.Now()
+	}
+
+	room.lastId++
+	msg := ChatMessage{Msg_Type: "chat",
+		Message_Id:  room.lastId,
+		Player_Name: name,
+		Host:        host,
+		Text:        filterChat(text),
+		Sent:        time.Now().Unix()}
+	room.history = append(room.history, msg)
+	if over := len(room.history) - serverConfig.ChatHistory; over > 0 {
+		room.history = append([]ChatMessage(nil), room.history[over:]...)
+	}
+	sendReply(c, NewAckReply(cmd, map[string]int64{"message_id": msg.Message_Id}))
+	h.broadcastChat(msg)
+}
+
+// broadcastChat sends msg to the admins and players, spectators only
+// follow the board.
+func (h *SessionHub) broadcastChat(msg interface{}) {
+	out, err := NewBroadcast(msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for c := range h.admins {
+		c.SendOutbound(out)
+	}
+	for _, pc := range h.players {
+		pc.SendOutbound(out)
+	}
+}
+
+// sendChatHistory catches a joining client up on the chat.
+func (h *SessionHub) sendChatHistory(c *Client) {
+	c.SendJSON(ChatHistory{Msg_Type: "chat_history",
+		Messages:  h.chatRoom.history,
+		Slow_Mode: int(h.chatRoom.slowMode.Seconds()),
+		Muted:     h.chatRoom.muted[h.playerNames[c]]})
+}
+
+func (h *SessionHub) mute(c *Client, cmd *Command) {
+	var payload MutePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	if _, ok := h.game.GamePlayers[payload.PlayerName]; !ok {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "no player named: %s", payload.PlayerName))
+		return
+	}
+	if payload.Muted {
+		h.chatRoom.muted[payload.PlayerName] = true
+	} else {
+		delete(h.chatRoom.muted, payload.PlayerName)
+	}
+	log.Println("Admin: chat mute of", payload.PlayerName, "set to", payload.Muted)
+	sendReply(c, NewAckReply(cmd, nil))
+	h.broadcastChat(ChatNotice{Msg_Type: "chat_muted", Player_Name: payload.PlayerName, Muted: payload.Muted})
+}
+
+func (h *SessionHub) deleteMessage(c *Client, cmd *Command) {
+	var payload DeleteMessagePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	room := h.chatRoom
+	if payload.MessageId <= 0 || payload.MessageId > room.lastId {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "no chat message: %d", payload.MessageId))
+		return
+	}
+	for i, msg := range room.history {
+		if msg.Message_Id == payload.MessageId {
+			room.history = append(room.history[:i:i], room.history[i+1:]...)
+			break
+		}
+	}
+	sendReply(c, NewAckReply(cmd, nil))
+	h.broadcastChat(ChatNotice{Msg_Type: "chat_deleted", Message_Id: payload.MessageId})
+}
+
+func (h *SessionHub) setSlowMode(c *Client, cmd *Command) {
+	var payload SlowModePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	if payload.Seconds < 0 {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "slow mode can't be negative"))
+		return
+	}
+	h.chatRoom.slowMode = time.Duration(payload.Seconds) * time.Second
+	log.Println("Admin: chat slow mode set to", payload.Seconds, "seconds")
+	sendReply(c, NewAckReply(cmd, nil))
+	h.broadcastChat(ChatNotice{Msg_Type: "chat_slow_mode", Slow_Mode: payload.Seconds})
+}
@@ -0,0 +1,372 @@
+/*
+*
+* Running several instances.
+* Every session is run by the one instance holding its lease on the
+* broker. A client connected to another instance has its commands
+* forwarded to the owner, where a relayed Client joins the hub in its
+* place. Whatever the hub sends it, events included, is relayed back
+* as is, so the clients of all instances get identical event streams.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// Session leases are renewed by their owner every third of the lease.
+//
+const (
+	SESSION_LEASE = 30 * time.Second
+)
+
+//
+// Kinds of messages exchanged between instances.
+//
+const (
+	// A command of a client, to the instance running its session.
+	CLUSTER_COMMAND = "command"
+	// The client has left, to the instance running its session.
+	CLUSTER_LEAVE = "leave"
+	// A message for the client, to the instance it is connected to.
+	CLUSTER_DELIVER = "deliver"
+	// The session closed the client, to the instance it is connected to.
+	CLUSTER_CLOSE = "close"
+)
+
+type ClusterMsg struct {
+	Kind string `json:"kind"`
+	// Instance the client is connected to.
+	From     string `json:"from,omitempty"`
+	ClientId string `json:"client_id"`
+	Role     string `json:"role,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	Code     int    `json:"code,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// Set for the clients of REST requests.
+	Request bool `json:"request,omitempty"`
+}
+
+// A Client of another instance joining the sessions run here.
+type RelayedClient struct {
+	*Client
+	key      string
+	from     string
+	clientId string
+	// Commands forwarded by the client's instance.
+	inbox chan []byte
+}
+
+var broker Broker = NewMemoryBroker()
+var instanceId string
+
+// Clients of this instance in sessions run elsewhere, by cluster id.
+var forwardedClients map[string]*Client
+var forwardedClientsLock sync.Mutex
+
+// Relayed clients by instance and cluster id.
+var relayedClients map[string]*RelayedClient
+var relayedClientsLock sync.Mutex
+
+func sessionKey(sessionId string) string {
+	return "bingo:session:" + sessionId + ":owner"
+}
+
+func instanceTopic(instance string) string {
+	return "bingo:instance:" + instance
+}
+
+// startCluster connects to the broker and starts taking the messages
+// other instances send to this one.
+func startCluster(cfg ServerConfig) error {
+	b, err := NewBroker(cfg.Broker)
+	if err != nil {
+		return err
+	}
+	broker = b
+	if cfg.InstanceId != "" {
+		instanceId = cfg.InstanceId
+	}
+	sub, err := broker.Subscribe(instanceTopic(instanceId))
+	if err != nil {
+		return err
+	}
+	log.Println("Instance", instanceId, "joined broker", cfg.Broker)
+	go receiveCluster(sub)
+	return nil
+}
+
+func receiveCluster(sub Subscription) {
+	for {
+		for data := range sub.Messages() {
+			var msg ClusterMsg
+			if err := json.Unmarshal(data, &msg); err != nil {
+				log.Println("malformed cluster message:", err)
+				continue
+			}
+			handleClusterMsg(&msg)
+		}
+		sub.Close()
+		log.Println("lost the broker subscription, subscribing again")
+		for {
+			var err error
+			if sub, err = broker.Subscribe(instanceTopic(instanceId)); err == nil {
+				break
+			}
+			log.Println(err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func handleClusterMsg(msg *ClusterMsg) {
+	switch msg.Kind {
+	case CLUSTER_COMMAND:
+		relayCommand(msg)
+	case CLUSTER_LEAVE:
+		key := msg.From + "/" + msg.ClientId
+		relayedClientsLock.Lock()
+		c := relayedClients[key]
+		relayedClientsLock.Unlock()
+		if c != nil {
+			dropRelayedClient(c)
+		}
+	case CLUSTER_DELIVER, CLUSTER_CLOSE:
+		forwardedClientsLock.Lock()
+		c := forwardedClients[msg.ClientId]
+		forwardedClientsLock.Unlock()
+		if c == nil {
+			return
+		}
+		if msg.Kind == CLUSTER_DELIVER {
+			c.Send(msg.Data)
+		} else {
+			c.Close(msg.Code, msg.Reason)
+		}
+	}
+}
+
+func publishCluster(instance string, msg ClusterMsg) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return broker.Publish(instanceTopic(instance), data)
+}
+
+// lookupSession returns the hub of a session run here, or the instance
+// running it elsewhere. With open a session nobody runs is opened here.
+func lookupSession(sessionId string, open bool) (*SessionHub, string, error) {
+	gamesLock.Lock()
+	b, ok := games.activeSessions[sessionId]
+	gamesLock.Unlock()
+	if ok {
+		return b.hub, "", nil
+	}
+	var owner string
+	var err error
+	if open {
+		owner, err = broker.Claim(sessionKey(sessionId), instanceId, SESSION_LEASE)
+	} else {
+		owner, err = broker.Owner(sessionKey(sessionId))
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if owner == instanceId {
+		if open {
+			return OpenSessionHub(sessionId), "", nil
+		}
+		owner = ""
+	}
+	return nil, owner, nil
+}
+
+// sessionActive reports whether a session is run by any instance.
+func sessionActive(sessionId string) bool {
+	hub, owner, err := lookupSession(sessionId, false)
+	if err != nil {
+		log.Println(err)
+	}
+	return hub != nil || owner != ""
+}
+
+// keepLease renews the lease of the session until the game is over, or
+// until another instance took it over.
+func (h *SessionHub) keepLease() {
+	ticker := time.NewTicker(SESSION_LEASE / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !h.renewLease() {
+				return
+			}
+		case <-h.done:
+			if err := broker.Release(sessionKey(h.game.GameId), instanceId); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+// renewLease claims the session for another lease, false when another
+// instance holds it and the hub was stopped.
+func (h *SessionHub) renewLease() bool {
+	owner, err := broker.Claim(sessionKey(h.game.GameId), instanceId, SESSION_LEASE)
+	if err != nil {
+		log.Println("couldn't renew the lease of", h.game.GameId, err)
+		return true
+	}
+	if owner == instanceId {
+		return true
+	}
+	log.Println("lost the lease of", h.game.GameId, "to", owner)
+	h.call(h.abandon)
+	return false
+}
+
+// abandon stops the hub of a session another instance runs now. Its
+// clients are closed to reconnect, their commands then go to the new
+// owner.
+func (h *SessionHub) abandon() {
+	h.stopSaver()
+	gamesLock.Lock()
+	if games.activeSessions[h.game.GameId] == h.game {
+		delete(games.activeSessions, h.game.GameId)
+	}
+	gamesLock.Unlock()
+
+	for c := range h.admins {
+		c.Close(websocket.CloseTryAgainLater, ERR_SESSION_MOVED)
+	}
+	for _, pc := range h.players {
+		pc.Close(websocket.CloseTryAgainLater, ERR_SESSION_MOVED)
+	}
+	for c := range h.spectators {
+		c.Close(websocket.CloseTryAgainLater, ERR_SESSION_MOVED)
+	}
+	close(h.done)
+}
+
+// forward sends a command of the client to the instance running its
+// session.
+func (c *Client) forward(owner string, msg []byte) error {
+	forwardedClientsLock.Lock()
+	if c.clusterId == "" {
+		c.clusterId = newResumeToken()
+	}
+	forwardedClients[c.clusterId] = c
+	forwardedClientsLock.Unlock()
+	c.owner = owner
+	err := publishCluster(owner, ClusterMsg{Kind: CLUSTER_COMMAND,
+		From:     instanceId,
+		ClientId: c.clusterId,
+		Role:     c.role,
+		Addr:     c.addr,
+		Request:  c.request,
+		Data:     msg})
+	if err != nil {
+		return NewProtocolError(ERR_INTERNAL, "couldn't reach the instance running the session: %v", err)
+	}
+	return nil
+}
+
+// leaveOwner tells the instance running the client's session that the
+// client has gone.
+func (c *Client) leaveOwner() {
+	forwardedClientsLock.Lock()
+	delete(forwardedClients, c.clusterId)
+	forwardedClientsLock.Unlock()
+	err := publishCluster(c.owner, ClusterMsg{Kind: CLUSTER_LEAVE, From: instanceId, ClientId: c.clusterId})
+	if err != nil {
+		log.Println(err)
+	}
+	c.owner = ""
+}
+
+// relayCommand hands a forwarded command to the relayed client of its
+// sender, which is created on its first command.
+func relayCommand(msg *ClusterMsg) {
+	key := msg.From + "/" + msg.ClientId
+	relayedClientsLock.Lock()
+	defer relayedClientsLock.Unlock()
+	c, ok := relayedClients[key]
+	if !ok {
+		c = &RelayedClient{Client: NewClient(nil, msg.Role),
+			key:      key,
+			from:     msg.From,
+			clientId: msg.ClientId,
+			inbox:    make(chan []byte, CLIENT_SEND_QUEUE)}
+		c.addr = msg.From + "/" + msg.Addr
+		c.relayed = true
+		c.request = msg.Request
+		relayedClients[key] = c
+		go c.relayPump()
+		go c.relayCommands()
+	}
+	select {
+	case c.inbox <- msg.Data:
+	default:
+		log.Println("dropping command of relayed client:", c.addr)
+	}
+}
+
+func dropRelayedClient(c *RelayedClient) {
+	relayedClientsLock.Lock()
+	defer relayedClientsLock.Unlock()
+	if relayedClients[c.key] == c {
+		delete(relayedClients, c.key)
+		close(c.inbox)
+	}
+}
+
+// relayCommands plays the read pump of a relayed client.
+func (c *RelayedClient) relayCommands() {
+	defer func() {
+		c.leaveSession()
+		c.Close(websocket.CloseNormalClosure, "")
+	}()
+	for msg := range c.inbox {
+		if !c.handleMessage(msg) {
+			return
+		}
+	}
+}
+
+// relayPump plays the write pump of a relayed client, its messages go
+// to the instance it is connected to.
+func (c *RelayedClient) relayPump() {
+	defer func() {
+		untrackClient(c.Client)
+		dropRelayedClient(c)
+	}()
+	for out := range c.send {
+		if c.isEvicted() {
+			break
+		}
+		if err := publishCluster(c.from, ClusterMsg{Kind: CLUSTER_DELIVER, ClientId: c.clientId, Data: out.data}); err != nil {
+			log.Println(err)
+		}
+	}
+	err := publishCluster(c.from, ClusterMsg{Kind: CLUSTER_CLOSE,
+		ClientId: c.clientId,
+		Code:     c.closeCode,
+		Reason:   c.closeReason})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func init() {
+	instanceId = newResumeToken()[:12]
+	forwardedClients = make(map[string]*Client)
+	relayedClients = make(map[string]*RelayedClient)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLostLease(t *testing.T) {
+	h := OpenSessionHub("lease-lost")
+	admin := NewClient(nil, ROLE_ADMIN)
+	player := NewClient(nil, ROLE_PLAYER)
+	defer untrackClient(admin)
+	defer untrackClient(player)
+	h.call(func() {
+		h.join(admin, "")
+		h.players["ann"] = player
+	})
+	if !h.renewLease() {
+		t.Fatal("lost a lease nobody else holds")
+	}
+
+	// Another instance takes the session over once the lease ran out.
+	key := sessionKey("lease-lost")
+	broker.Release(key, instanceId)
+	if owner, _ := broker.Claim(key, "other", time.Minute); owner != "other" {
+		t.Fatal("claimed by", owner)
+	}
+	if h.renewLease() {
+		t.Fatal("kept a lease another instance holds")
+	}
+	select {
+	case <-h.done:
+	default:
+		t.Fatal("hub still running")
+	}
+	for _, c := range []*Client{admin, player} {
+		if c.closeCode != websocket.CloseTryAgainLater || c.closeReason != ERR_SESSION_MOVED {
+			t.Fatal(c.role, c.closeCode, c.closeReason)
+		}
+	}
+	if hub, owner, _ := lookupSession("lease-lost", false); hub != nil || owner != "other" {
+		t.Fatal(hub, owner)
+	}
+	if owner, _ := broker.Owner(key); owner != "other" {
+		t.Fatal("lease given up for", owner)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+*
+* Server configuration.
+* Defaults can be overridden with command line flags.
+*
+ */
+package main
+
+import (
+	"compress/flate"
+	"flag"
+	"strings"
+	"time"
+)
+
+type ServerConfig struct {
+	ListenAddr        string
+	ReadBufferSize    int
+	WriteBufferSize   int
+	HandshakeTimeout  time.Duration
+	EnableCompression bool
+	CompressionLevel  int
+	// Largest message accepted from a client, in bytes.
+	ReadLimit int64
+	// Origins allowed to open websockets, empty for the server's own host.
+	AllowedOrigins []string
+	// Key signing handshake tickets, a random one when empty.
+	TicketSecret string
+	TicketTTL    time.Duration
+	// Concurrent websockets per remote IP, zero for no cap.
+	MaxConnsPerIP int
+	// Commands a connection may send across all command types.
+	CommandLimit RateLimit
+	// Throttled commands tolerated before the connection is dropped.
+	StrikeLimit RateLimit
+	// Time allowed to close all connections on shutdown.
+	ShutdownTimeout time.Duration
+	// Broker shared by the instances, "memory" for a single instance or
+	// redis://[:password@]host:port.
+	Broker string
+	// Name of the instance on the broker, a random one when empty.
+	InstanceId string
+	// Longest chat message in characters.
+	ChatMaxLength int
+	// Chat messages kept for joining players.
+	ChatHistory int
+	// Words masked in chat messages.
+	ChatBlocklist []string
+	// Time a disconnected player keeps the card, zero for the whole game.
+	PlayerGrace time.Duration
+	// Time without a message after which a player is idle, zero for never.
+	PlayerIdle time.Duration
+	// Lifetime of co-host invites.
+	InviteTTL time.Duration
+	// Time the owner may be away before a co-host takes over.
+	OwnerGrace time.Duration
+	// URLs every session posts its events to.
+	Webhooks []string
+	// Events posted to them, all of them when empty.
+	WebhookEvents []string
+	// Key signing the deliveries to them, a random one when empty.
+	WebhookSecret  string
+	WebhookTimeout time.Duration
+	// Retries of a failed delivery, the first after WebhookBackoff and
+	// each following one twice as late.
+	WebhookRetries int
+	WebhookBackoff time.Duration
+	// File deliveries that failed for good are appended to, empty for the
+	// server log only.
+	WebhookDeadLetter string
+	// Post every delivery to a local stand-in receiver.
+	WebhookTest bool
+	// Hosts the webhooks of a session may be on although they are local
+	// or private. Others must resolve to public addresses.
+	WebhookAllow []string
+	// Store the active sessions are saved to and restored from on
+	// startup, "memory", json:dir or bolt:path.
+	Store string
+}
+
+var serverConfig = DefaultServerConfig()
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{ListenAddr: "192.168.11.23:80",
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		HandshakeTimeout:  10 * time.Second,
+		EnableCompression: true,
+		CompressionLevel:  flate.BestSpeed,
+		ReadLimit:         4096,
+		TicketTTL:         30 * time.Second,
+		// Players at a venue often share one NAT address.
+		MaxConnsPerIP: 200,
+		CommandLimit:  RateLimit{Rate: 10, Burst: 20},
+		StrikeLimit:   RateLimit{Rate: 0.1, Burst: 5},
+
+		ShutdownTimeout: 10 * time.Second,
+		Broker:          "memory",
+		ChatMaxLength:   200,
+		ChatHistory:     50,
+		PlayerGrace:     2 * time.Minute,
+		PlayerIdle:      2 * time.Minute,
+		InviteTTL:       24 * time.Hour,
+		OwnerGrace:      time.Minute,
+
+		WebhookTimeout:    5 * time.Second,
+		WebhookRetries:    5,
+		WebhookBackoff:    time.Second,
+		WebhookDeadLetter: "webhook-dead-letters.log",
+		Store:             "memory",
+	}
+}
+
+func (c *ServerConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "address to listen on")
+	fs.IntVar(&c.ReadBufferSize, "ws-read-buffer", c.ReadBufferSize, "websocket read buffer size in bytes")
+	fs.IntVar(&c.WriteBufferSize, "ws-write-buffer", c.WriteBufferSize, "websocket write buffer size in bytes")
+	fs.DurationVar(&c.HandshakeTimeout, "ws-handshake-timeout", c.HandshakeTimeout, "websocket handshake timeout")
+	fs.BoolVar(&c.EnableCompression, "ws-compression", c.EnableCompression, "negotiate permessage-deflate")
+	fs.IntVar(&c.CompressionLevel, "ws-compression-level", c.CompressionLevel, "deflate level, 1 (speed) to 9 (size)")
+	fs.Int64Var(&c.ReadLimit, "ws-read-limit", c.ReadLimit, "largest message accepted from a client in bytes")
+	fs.Func("allowed-origins", "comma separated origins allowed to open websockets", func(v string) error {
+		c.AllowedOrigins = splitList(v)
+		return nil
+	})
+	fs.StringVar(&c.TicketSecret, "ticket-secret", c.TicketSecret, "key signing websocket handshake tickets")
+	fs.DurationVar(&c.TicketTTL, "ticket-ttl", c.TicketTTL, "lifetime of websocket handshake tickets")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", c.MaxConnsPerIP, "concurrent websockets per remote IP, 0 for no cap")
+	fs.Float64Var(&c.CommandLimit.Rate, "command-rate", c.CommandLimit.Rate, "commands per second a connection may send")
+	fs.Float64Var(&c.CommandLimit.Burst, "command-burst", c.CommandLimit.Burst, "command burst a connection may send")
+	fs.Float64Var(&c.StrikeLimit.Burst, "max-strikes", c.StrikeLimit.Burst, "throttled commands tolerated before disconnecting")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time allowed to close all connections on shutdown")
+	fs.StringVar(&c.Broker, "broker", c.Broker, "broker shared by the instances, memory or redis://host:port")
+	fs.StringVar(&c.InstanceId, "instance-id", c.InstanceId, "name of this instance on the broker")
+	fs.IntVar(&c.ChatMaxLength, "chat-max-length", c.ChatMaxLength, "longest chat message in characters")
+	fs.IntVar(&c.ChatHistory, "chat-history", c.ChatHistory, "chat messages kept for joining players")
+	fs.Func("chat-blocklist", "comma separated words masked in chat messages", func(v string) error {
+		c.ChatBlocklist = splitList(v)
+		return nil
+	})
+	fs.DurationVar(&c.PlayerGrace, "player-grace", c.PlayerGrace, "time a disconnected player keeps the card, 0 for the whole game")
+	fs.DurationVar(&c.PlayerIdle, "player-idle", c.PlayerIdle, "time without a message after which a player is idle, 0 for never")
+	fs.DurationVar(&c.InviteTTL, "invite-ttl", c.InviteTTL, "lifetime of co-host invites")
+	fs.DurationVar(&c.OwnerGrace, "owner-grace", c.OwnerGrace, "time the owner may be away before a co-host takes over")
+	fs.Func("webhooks", "comma separated URLs every session posts its events to", func(v string) error {
+		c.Webhooks = splitList(v)
+		return nil
+	})
+	fs.Func("webhook-events", "comma separated events posted to the webhooks, all when empty", func(v string) error {
+		c.WebhookEvents = splitList(v)
+		return nil
+	})
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", c.WebhookSecret, "key signing webhook deliveries")
+	fs.DurationVar(&c.WebhookTimeout, "webhook-timeout", c.WebhookTimeout, "time allowed for a webhook delivery")
+	fs.IntVar(&c.WebhookRetries, "webhook-retries", c.WebhookRetries, "retries of a failed webhook delivery")
+	fs.DurationVar(&c.WebhookBackoff, "webhook-backoff", c.WebhookBackoff, "wait before the first retry, doubled for each next one")
+	fs.StringVar(&c.WebhookDeadLetter, "webhook-dead-letter", c.WebhookDeadLetter, "file failed webhook deliveries are appended to")
+	fs.BoolVar(&c.WebhookTest, "webhook-test", c.WebhookTest, "post webhook deliveries to a local stand-in receiver")
+	fs.Func("webhook-allow", "comma separated hosts session webhooks may be on although they are private", func(v string) error {
+		c.WebhookAllow = splitList(v)
+		return nil
+	})
+	fs.StringVar(&c.Store, "store", c.Store, "store active sessions survive restarts in, memory, json:dir or bolt:path")
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(v string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
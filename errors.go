@@ -0,0 +1,106 @@
+/*
+*
+* Error frames sent to websocket clients.
+* Every error carries a machine readable code. Fatal errors are followed
+* by a websocket close frame with a matching close code and reason.
+*
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"time"
+)
+
+//
+// Machine readable error codes.
+//
+const (
+	ERR_SESSION_NOT_FOUND = "session_not_found"
+	ERR_SESSION_EXISTS    = "session_exists"
+	ERR_SESSION_MOVED     = "session_moved"
+	ERR_INVALID_COMMAND   = "invalid_command"
+	ERR_INVALID_PAYLOAD   = "invalid_payload"
+	ERR_UNSUPPORTED       = "unsupported_version"
+	ERR_GAME_OVER         = "game_over"
+	ERR_ALL_DRAWN         = "all_drawn"
+	ERR_SLOW_CONSUMER     = "slow_consumer"
+	ERR_NAME_TAKEN        = "name_taken"
+	ERR_INVALID_TOKEN     = "invalid_token"
+	ERR_MESSAGE_TOO_BIG   = "message_too_big"
+	ERR_RATE_LIMITED      = "rate_limited"
+	ERR_MUTED             = "muted"
+	ERR_SLOW_MODE         = "slow_mode"
+	ERR_FORBIDDEN         = "forbidden"
+	ERR_INTERNAL          = "internal_error"
+)
+
+//
+// Time allowed to write a close frame to the peer.
+//
+const (
+	CLOSE_GRACE_PERIOD = time.Second
+)
+
+type ProtocolError struct {
+	Code    string
+	Message string
+	// Websocket close code, zero for errors the connection survives.
+	CloseCode int
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func (e *ProtocolError) Fatal() bool {
+	return e.CloseCode != 0
+}
+
+func NewProtocolError(code string, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func NewFatalError(closeCode int, code string, format string, args ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...), CloseCode: closeCode}
+}
+
+// asProtocolError maps any error onto a ProtocolError, unknown errors
+// are reported as internal errors.
+func asProtocolError(err error) *ProtocolError {
+	if pErr, ok := err.(*ProtocolError); ok {
+		return pErr
+	}
+	return &ProtocolError{Code: ERR_INTERNAL, Message: err.Error(), CloseCode: websocket.CloseInternalServerErr}
+}
+
+// sendError queues an error frame for err. Fatal errors also close the
+// client. It returns false once the client is no longer usable.
+func sendError(c *Client, cmd *Command, err error) bool {
+	pErr := asProtocolError(err)
+	log.Println("websocket error:", c.addr, pErr)
+	if !sendReply(c, NewErrorReply(cmd, pErr)) {
+		return false
+	}
+	if pErr.Fatal() {
+		c.Close(pErr.CloseCode, pErr.Message)
+		return false
+	}
+	return true
+}
+
+// closeConn sends a close frame with code and reason and closes the
+// underlying connection.
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	// Close frame payload is limited to 125 bytes, 2 of which hold the code.
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	if err := conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(CLOSE_GRACE_PERIOD)); err != nil {
+		log.Println(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,186 @@
+/*
+*
+* Session events.
+* Every event a hub broadcasts gets the next sequence number of its
+* session and is kept in a bounded ring, so a reconnecting client can be
+* sent exactly the events it missed.
+*
+ */
+package main
+
+import (
+	"sort"
+)
+
+//
+// Number of recent events kept per session. A replay has to fit in the
+// client's send queue, larger gaps get a snapshot.
+//
+const (
+	EVENT_RING_SIZE = CLIENT_SEND_QUEUE / 2
+)
+
+//
+// Who receives an event.
+//
+const (
+	AUDIENCE_ADMINS  = 1 << iota
+	AUDIENCE_PLAYERS
+	AUDIENCE_ALL = AUDIENCE_ADMINS | AUDIENCE_PLAYERS
+)
+
+type SessionEvent struct {
+	Seq      int64
+	Audience int
+	Msg      WebMsgOut
+}
+
+type EventRing struct {
+	events  []*SessionEvent
+	start   int
+	count   int
+	lastSeq int64
+}
+
+func NewEventRing(size int) *EventRing {
+	return &EventRing{events: make([]*SessionEvent, size)}
+}
+
+// Append numbers the event and stores it, dropping the oldest one when
+// the ring is full.
+func (r *EventRing) Append(audience int, msg WebMsgOut) *SessionEvent {
+	r.lastSeq++
+	msg.Seq = r.lastSeq
+	ev := &SessionEvent{Seq: r.lastSeq, Audience: audience, Msg: msg}
+	if r.count < len(r.events) {
+		r.events[(r.start+r.count)%len(r.events)] = ev
+		r.count++
+	} else {
+		r.events[r.start] = ev
+		r.start = (r.start + 1) % len(r.events)
+	}
+	return ev
+}
+
+func (r *EventRing) LastSeq() int64 {
+	return r.lastSeq
+}
+
+// Since returns the events after seq. It returns false when some of them
+// were already dropped, or were sent before the session was restored,
+// or seq is ahead of the session, in which case the client needs a full
+// snapshot instead.
+func (r *EventRing) Since(seq int64) ([]*SessionEvent, bool) {
+	if seq > r.lastSeq || (r.count == 0 && seq < r.lastSeq) {
+		return nil, false
+	}
+	if r.count > 0 && seq+1 < r.events[r.start].Seq {
+		return nil, false
+	}
+	missed := make([]*SessionEvent, 0)
+	for i := 0; i < r.count; i++ {
+		ev := r.events[(r.start+i)%len(r.events)]
+		if ev.Seq > seq {
+			missed = append(missed, ev)
+		}
+	}
+	return missed, true
+}
+
+// Player in the roster of a session snapshot.
+type SnapshotPlayer struct {
+	Player_Name string `json:"player_name"`
+	Presence    string `json:"presence"`
+	// Cards dealt to the player, re-rolls included.
+	Cards int `json:"cards"`
+	// Cells of the current card that have been drawn.
+	Marked int  `json:"marked"`
+	Winner bool `json:"winner"`
+	// The current card, only when asked for.
+	Player_Sheet [][]int `json:"player_sheet,omitempty"`
+}
+
+type PrizeStatus struct {
+	Pattern string   `json:"pattern"`
+	Won     bool     `json:"won"`
+	Winners []string `json:"winners"`
+}
+
+// Complete session state, sent to an admin when it connects and when it
+// missed too many events.
+type SessionSnapshot struct {
+	Msg_Type   string           `json:"msg_type"`
+	Seq        int64            `json:"seq"`
+	Session_Id string           `json:"session_id"`
+	Game_Link  string           `json:"game_link"`
+	Players    []SnapshotPlayer `json:"players"`
+	Draws      []int            `json:"draws"`
+	Prizes     []PrizeStatus    `json:"prizes"`
+	Spectators int              `json:"spectators"`
+	Game_State string           `json:"game_state"`
+}
+
+// replay sends c the events it missed since lastSeq. It returns false
+// when they are no longer in the ring.
+func (h *SessionHub) replay(c *Client, lastSeq int64) bool {
+	missed, ok := h.events.Since(lastSeq)
+	if !ok {
+		return false
+	}
+	for _, ev := range missed {
+		if (c.role == ROLE_ADMIN && ev.Audience&AUDIENCE_ADMINS != 0) ||
+			(c.role == ROLE_PLAYER && ev.Audience&AUDIENCE_PLAYERS != 0) {
+			c.SendJSON(ev.Msg)
+		}
+	}
+	return true
+}
+
+func (h *SessionHub) sendSnapshot(c *Client, cards bool) {
+	c.SendJSON(h.snapshot(cards))
+}
+
+// snapshot builds the session state, the roster sorted by name and the
+// draws in draw order. With cards the roster has the players' cards.
+func (h *SessionHub) snapshot(cards bool) SessionSnapshot {
+	b := h.game
+	draws := b.drawnNumbers()
+	snapshot := SessionSnapshot{Msg_Type: "session_snapshot",
+		Seq:        h.events.LastSeq(),
+		Session_Id: b.GameId,
+		Game_Link:  b.GameLink,
+		Players:    make([]SnapshotPlayer, 0, len(b.GamePlayers)),
+		Draws:      draws,
+		Prizes: []PrizeStatus{{Pattern: b.pattern(),
+			Won:     len(b.winners) > 0,
+			Winners: append([]string{}, b.winners...)}},
+		Spectators: len(h.spectators),
+		Game_State: b.state()}
+	winners := make(map[string]bool)
+	for _, winner := range b.winners {
+		winners[winner] = true
+	}
+	for name, playerSheet := range b.GamePlayers {
+		marked := 0
+		for _, col := range playerSheet.marks(draws) {
+			for _, m := range col {
+				if m {
+					marked++
+				}
+			}
+		}
+		player := SnapshotPlayer{Player_Name: name,
+			Presence: playerSheet.Presence,
+			Cards:    playerSheet.SheetId,
+			Marked:   marked,
+			Winner:   winners[name]}
+		if cards {
+			player.Player_Sheet = playerSheet.Sheet
+		}
+		snapshot.Players = append(snapshot.Players, player)
+	}
+	sort.Slice(snapshot.Players, func(i, j int) bool {
+		return snapshot.Players[i].Player_Name < snapshot.Players[j].Player_Name
+	})
+	return snapshot
+}
@@ -0,0 +1,222 @@
+/*
+*
+* Game event log.
+* Every change of a BingoGame is recorded as an event appended to its
+* log, and the state of the game is the fold of those events. Random
+* cards and draws are picked before they are recorded, so replaying the
+* log of a game rebuilds it exactly.
+*
+ */
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+//
+// Events of the game log.
+//
+const (
+	GAME_EVENT_CREATED       = "created"
+	GAME_EVENT_PLAYER_JOINED = "player_joined"
+	GAME_EVENT_CARD_DEALT    = "card_dealt"
+	GAME_EVENT_NUMBER_DRAWN  = "number_drawn"
+	GAME_EVENT_DAUB          = "daub"
+	GAME_EVENT_PRIZE_WON     = "prize_won"
+	GAME_EVENT_PLAYER_LEFT   = "player_left"
+	GAME_EVENT_ENDED         = "ended"
+)
+
+// A change of a game, with the fields of its type set.
+type GameEvent struct {
+	Seq  int64  `json:"seq"`
+	Type string `json:"type"`
+	Time int64  `json:"time"`
+	// created
+	GameId   string `json:"game_id,omitempty"`
+	GameLink string `json:"game_link,omitempty"`
+	// player_joined, card_dealt, daub, prize_won and player_left
+	PlayerName  string  `json:"player_name,omitempty"`
+	ResumeToken string  `json:"resume_token,omitempty"`
+	SheetId     int     `json:"sheet_id,omitempty"`
+	Sheet       [][]int `json:"sheet,omitempty"`
+	// number_drawn and daub, the column and row of the daubed cell.
+	DrawNumber int   `json:"draw_number,omitempty"`
+	Cell       []int `json:"cell,omitempty"`
+	// prize_won
+	Pattern string `json:"pattern,omitempty"`
+	// ended
+	Winners []string `json:"winners,omitempty"`
+}
+
+// record appends ev to the log of the game and applies it. Events are
+// checked before they are recorded, one that can't be applied is a bug.
+func (b *BingoGame) record(ev GameEvent) {
+	ev.Seq = int64(len(b.gameLog)) + 1
+	if ev.Time == 0 {
+		ev.Time = time.Now().Unix()
+	}
+	if err := b.apply(ev); err != nil {
+		log.Panic(err)
+	}
+	b.gameLog = append(b.gameLog, ev)
+}
+
+// apply folds ev into the state of the game.
+func (b *BingoGame) apply(ev GameEvent) error {
+	if ev.Type != GAME_EVENT_CREATED && b.GamePlayers == nil {
+		return fmt.Errorf("game event %d: %s before the game was created", ev.Seq, ev.Type)
+	}
+	playerSheet := b.GamePlayers[ev.PlayerName]
+	switch ev.Type {
+	case GAME_EVENT_CREATED:
+		b.GameId = ev.GameId
+		b.GameLink = ev.GameLink
+		b.GamePlayers = make(map[string]*BingoSheet)
+		b.draws = make([]int, 100)
+		b.drawCount = 0
+		return nil
+	case GAME_EVENT_PLAYER_JOINED:
+		if playerSheet != nil {
+			return fmt.Errorf("game event %d: player %s joined twice", ev.Seq, ev.PlayerName)
+		}
+		b.GamePlayers[ev.PlayerName] = &BingoSheet{resumeToken: ev.ResumeToken}
+		return nil
+	case GAME_EVENT_NUMBER_DRAWN:
+		if b.drawCount == len(b.draws) {
+			return fmt.Errorf("game event %d: no draws left", ev.Seq)
+		}
+		b.draws[b.drawCount] = ev.DrawNumber
+		b.drawCount += 1
+		return nil
+	case GAME_EVENT_ENDED:
+		b.ended = true
+		return nil
+	}
+
+	if playerSheet == nil {
+		return fmt.Errorf("game event %d: %s for unknown player %s", ev.Seq, ev.Type, ev.PlayerName)
+	}
+	switch ev.Type {
+	case GAME_EVENT_CARD_DEALT:
+		playerSheet.SheetId = ev.SheetId
+		playerSheet.Sheet = copySheet(ev.Sheet)
+		playerSheet.dealtAt = b.drawCount
+		playerSheet.totalMatchNeeded = 0
+		playerSheet.drawMatchCount = 0
+		for _, col := range playerSheet.Sheet {
+			for _, val := range col {
+				if val != -1 {
+					playerSheet.totalMatchNeeded += 1
+				}
+			}
+		}
+	case GAME_EVENT_DAUB:
+		if len(ev.Cell) != 2 || ev.Cell[0] < 0 || ev.Cell[1] < 0 || ev.Cell[0] >= len(playerSheet.Sheet) || ev.Cell[1] >= len(playerSheet.Sheet[ev.Cell[0]]) {
+			return fmt.Errorf("game event %d: daub outside the card of %s", ev.Seq, ev.PlayerName)
+		}
+		playerSheet.drawMatchCount += 1
+	case GAME_EVENT_PRIZE_WON:
+		playerSheet.fullHouseMatch = true
+		b.winnerFullHouse = true
+		b.winners = append(b.winners, ev.PlayerName)
+	case GAME_EVENT_PLAYER_LEFT:
+		delete(b.GamePlayers, ev.PlayerName)
+	default:
+		return fmt.Errorf("game event %d: unknown type %q", ev.Seq, ev.Type)
+	}
+	return nil
+}
+
+// ReplayGame rebuilds a game from its log.
+func ReplayGame(events []GameEvent) (*BingoGame, error) {
+	b := &BingoGame{}
+	for i, ev := range events {
+		if ev.Seq != int64(i)+1 {
+			return nil, fmt.Errorf("game event %d found at %d", ev.Seq, i+1)
+		}
+		if (i == 0) != (ev.Type == GAME_EVENT_CREATED) {
+			return nil, fmt.Errorf("game event %d: a log starts with a single %s", ev.Seq, GAME_EVENT_CREATED)
+		}
+		if err := b.apply(ev); err != nil {
+			return nil, err
+		}
+		b.gameLog = append(b.gameLog, ev)
+	}
+	if b.GamePlayers == nil {
+		return nil, fmt.Errorf("empty game log")
+	}
+	return b, nil
+}
+
+// GameLog returns the events recorded so far.
+func (b *BingoGame) GameLog() []GameEvent {
+	return append([]GameEvent{}, b.gameLog...)
+}
+
+// joinPlayer seats a new player, without a card until one is dealt.
+func (b *BingoGame) joinPlayer(playerName string, resumeToken string) {
+	b.record(GameEvent{Type: GAME_EVENT_PLAYER_JOINED, PlayerName: playerName, ResumeToken: resumeToken})
+}
+
+// dealCard gives a player a new card. As before the log, only the numbers
+// drawn from then on are daubed on it, those drawn already don't count.
+func (b *BingoGame) dealCard(playerName string, sheet [][]int) {
+	b.record(GameEvent{Type: GAME_EVENT_CARD_DEALT, PlayerName: playerName,
+		SheetId: b.GamePlayers[playerName].SheetId + 1,
+		Sheet:   sheet})
+}
+
+// drawNumber records a drawn number, daubs it on the cards and awards the
+// prize to the cards it completes. It returns their players by name.
+func (b *BingoGame) drawNumber(dNum int) []string {
+	b.record(GameEvent{Type: GAME_EVENT_NUMBER_DRAWN, DrawNumber: dNum})
+	names := make([]string, 0, len(b.GamePlayers))
+	for name := range b.GamePlayers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	winners := make([]string, 0)
+	for _, name := range names {
+		playerSheet := b.GamePlayers[name]
+		col, row, ok := playerSheet.findCell(dNum)
+		if !ok {
+			continue
+		}
+		b.record(GameEvent{Type: GAME_EVENT_DAUB, PlayerName: name, DrawNumber: dNum, Cell: []int{col, row}})
+		if !playerSheet.fullHouseMatch && playerSheet.drawMatchCount == playerSheet.totalMatchNeeded {
+			winners = append(winners, name)
+		}
+	}
+	for _, name := range winners {
+		b.record(GameEvent{Type: GAME_EVENT_PRIZE_WON, PlayerName: name, Pattern: b.pattern()})
+	}
+	return winners
+}
+
+func (b *BingoGame) removePlayer(playerName string) {
+	b.record(GameEvent{Type: GAME_EVENT_PLAYER_LEFT, PlayerName: playerName})
+}
+
+func (b *BingoGame) endGame() {
+	b.record(GameEvent{Type: GAME_EVENT_ENDED, Winners: append([]string(nil), b.winners...)})
+}
+
+// newCard returns a card with random numbers.
+func newCard() [][]int {
+	card, _ := NewBingoSheet()
+	card.populateSheet()
+	return card.Sheet
+}
+
+func copySheet(sheet [][]int) [][]int {
+	sheetCopy := make([][]int, len(sheet))
+	for i, col := range sheet {
+		sheetCopy[i] = append([]int(nil), col...)
+	}
+	return sheetCopy
+}
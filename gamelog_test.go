@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// card returns a card with the given numbers in its first column, every
+// other cell free, so a game is won after a known set of draws.
+func card(numbers ...int) [][]int {
+	sheet := make([][]int, SHEET_DIM)
+	for i := range sheet {
+		sheet[i] = []int{-1, -1, -1, -1, -1}
+	}
+	copy(sheet[0], numbers)
+	return sheet
+}
+
+func TestReplayGame(t *testing.T) {
+	tests := []struct {
+		name string
+		play func(b *BingoGame)
+		// Expected state of the live game.
+		state   string
+		winners []string
+	}{
+		{"empty", func(b *BingoGame) {}, GAME_WAITING, nil},
+		{"joins and draws", func(b *BingoGame) {
+			b.joinPlayer("ann", "t1")
+			b.dealCard("ann", card(1, 2, 3))
+			b.joinPlayer("bob", "t2")
+			b.dealCard("bob", card(4, 5, 6))
+			b.drawNumber(1)
+			b.drawNumber(7)
+		}, GAME_IN_PROGRESS, nil},
+		{"re-roll", func(b *BingoGame) {
+			b.joinPlayer("ann", "t1")
+			b.dealCard("ann", card(1, 2, 3))
+			b.drawNumber(1)
+			b.dealCard("ann", card(1, 4))
+			b.drawNumber(4)
+		}, GAME_IN_PROGRESS, nil},
+		{"late join", func(b *BingoGame) {
+			b.joinPlayer("ann", "t1")
+			b.dealCard("ann", card(1, 2, 3))
+			b.drawNumber(2)
+			b.joinPlayer("bob", "t2")
+			b.dealCard("bob", card(2, 5))
+			b.drawNumber(5)
+		}, GAME_IN_PROGRESS, nil},
+		{"player left", func(b *BingoGame) {
+			b.joinPlayer("ann", "t1")
+			b.dealCard("ann", card(1, 2))
+			b.joinPlayer("bob", "t2")
+			b.dealCard("bob", card(3, 4))
+			b.drawNumber(3)
+			b.removePlayer("bob")
+			b.drawNumber(4)
+		}, GAME_IN_PROGRESS, nil},
+		{"prize", func(b *BingoGame) {
+			b.joinPlayer("ann", "t1")
+			b.dealCard("ann", card(1, 2))
+			b.joinPlayer("bob", "t2")
+			b.dealCard("bob", card(2, 1, 9))
+			b.joinPlayer("cid", "t3")
+			b.dealCard("cid", card(1, 2))
+			b.drawNumber(1)
+			b.drawNumber(2)
+		}, GAME_OVER, []string{"ann", "cid"}},
+		{"ended without a winner", func(b *BingoGame) {
+			b.joinPlayer("ann", "t1")
+			b.dealCard("ann", card(1, 2))
+			b.drawNumber(1)
+			b.endGame()
+		}, GAME_OVER, nil},
+		{"random game to the end", func(b *BingoGame) {
+			for _, name := range []string{"ann", "bob", "cid"} {
+				b.joinPlayer(name, newResumeToken())
+				b.dealCard(name, newCard())
+			}
+			b.dealCard("bob", newCard())
+			for i := 0; i < 10; i++ {
+				b.drawNumber(DrawUniqRandNumber(b.draws))
+			}
+			b.removePlayer("cid")
+			for len(b.winners) == 0 {
+				b.drawNumber(DrawUniqRandNumber(b.draws))
+			}
+			b.endGame()
+		}, GAME_OVER, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := NewBingoGame("replay")
+			tt.play(b)
+			if b.state() != tt.state {
+				t.Fatalf("state %s, want %s", b.state(), tt.state)
+			}
+			if tt.winners != nil && !reflect.DeepEqual(b.winners, tt.winners) {
+				t.Fatalf("winners %v, want %v", b.winners, tt.winners)
+			}
+
+			// Through JSON, as a stored log is.
+			data, err := json.Marshal(b.GameLog())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var events []GameEvent
+			if err := json.Unmarshal(data, &events); err != nil {
+				t.Fatal(err)
+			}
+			replayed, err := ReplayGame(events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(b, replayed) {
+				t.Fatalf("replayed game differs\nlive:     %+v\nreplayed: %+v", b, replayed)
+			}
+		})
+	}
+}
+
+func TestReplayGameDaubs(t *testing.T) {
+	b, _ := NewBingoGame("daubs")
+	b.joinPlayer("ann", "t1")
+	b.dealCard("ann", card(1, 2, 3))
+	b.drawNumber(1)
+	// Numbers drawn before a card is dealt don't count on it.
+	b.dealCard("ann", card(1, 2))
+	if b.drawNumber(2); len(b.winners) != 0 {
+		t.Fatal("won with a number drawn before the card was dealt")
+	}
+	marks := b.GamePlayers["ann"].marks(b.drawnNumbers())
+	if marks[0][0] || !marks[0][1] {
+		t.Fatal(marks)
+	}
+	if b.drawNumber(1); !reflect.DeepEqual(b.winners, []string{"ann"}) {
+		t.Fatal(b.winners)
+	}
+}
+
+func TestReplayGameErrors(t *testing.T) {
+	b, _ := NewBingoGame("errors")
+	b.joinPlayer("ann", "t1")
+	b.dealCard("ann", card(1, 2))
+	b.drawNumber(1)
+	events := b.GameLog()
+
+	// with returns the log with its event at i replaced by ev.
+	with := func(i int, ev GameEvent) []GameEvent {
+		changed := append([]GameEvent{}, events...)
+		changed[i] = ev
+		return changed
+	}
+	tests := []struct {
+		name   string
+		events []GameEvent
+	}{
+		{"empty log", nil},
+		{"missing created", events[1:]},
+		{"created twice", append(append([]GameEvent{}, events...), GameEvent{Seq: 5, Type: GAME_EVENT_CREATED, GameId: "again"})},
+		{"bad seq", with(2, GameEvent{Seq: 7, Type: GAME_EVENT_CARD_DEALT, PlayerName: "ann", SheetId: 1, Sheet: card(1, 2)})},
+		{"joined twice", with(2, GameEvent{Seq: 3, Type: GAME_EVENT_PLAYER_JOINED, PlayerName: "ann"})},
+		{"unknown player", with(2, GameEvent{Seq: 3, Type: GAME_EVENT_CARD_DEALT, PlayerName: "bob", SheetId: 1, Sheet: card(1, 2)})},
+		{"daub outside the card", with(4, GameEvent{Seq: 5, Type: GAME_EVENT_DAUB, PlayerName: "ann", DrawNumber: 1, Cell: []int{0, 5}})},
+		{"daub without a cell", with(4, GameEvent{Seq: 5, Type: GAME_EVENT_DAUB, PlayerName: "ann", DrawNumber: 1})},
+		{"unknown type", with(4, GameEvent{Seq: 5, Type: "shuffled", PlayerName: "ann"})},
+	}
+	if _, err := ReplayGame(events); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReplayGame(tt.events); err == nil {
+				t.Fatal("replayed a bad log")
+			}
+		})
+	}
+}
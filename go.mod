@@ -0,0 +1,15 @@
+module go-websocket
+
+go 1.23
+
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
+	go.etcd.io/bbolt v1.4.3
+)
+
+require (
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+)
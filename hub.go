@@ -0,0 +1,756 @@
+/*
+*
+* Per session hub.
+* A SessionHub owns the admin and player clients of one BingoGame and is
+* the only goroutine that changes the game, so events of one game are
+* never routed to the connections of another one.
+* Each websocket connection is a Client with its own read and write pump,
+* event stream clients are fed by their stream handler instead.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// Client roles.
+//
+const (
+	ROLE_ADMIN     = "admin"
+	ROLE_PLAYER    = "player"
+	ROLE_SPECTATOR = "spectator"
+)
+
+//
+// Outbound queue limits.
+// A client whose queue overflows is evicted instead of stalling the game.
+//
+const (
+	CLIENT_SEND_QUEUE = 64
+	WRITE_WAIT        = 10 * time.Second
+)
+
+//
+// Heartbeats. The server pings every PING_PERIOD and drops a client that
+// hasn't answered with a pong within PONG_WAIT.
+//
+const (
+	PONG_WAIT   = 60 * time.Second
+	PING_PERIOD = (PONG_WAIT * 9) / 10
+)
+
+type Client struct {
+	// Websocket of the client, nil for event streams.
+	conn *websocket.Conn
+	addr string
+	// Wire level byte counter of conn, nil when not measured.
+	wire *countingConn
+	// Remote IP holding a connection slot, empty when none is held.
+	ip   string
+	role string
+	// Hub the client joined last, only used by the read pump.
+	hub     *SessionHub
+	limiter *ClientLimiter
+	send    chan *Outbound
+	// Session an event stream is bound to, empty for websockets.
+	session string
+	// Last event seen by an event stream before it reconnected.
+	resumeSeq int64
+	// Instance running the session the client's commands are forwarded
+	// to, and the client's id there.
+	owner     string
+	clusterId string
+	// Set for clients of another instance, their commands are never
+	// forwarded again.
+	relayed bool
+	// Set for the clients of REST requests, which come and go without
+	// the host leaving.
+	request bool
+
+	mu          sync.Mutex
+	lastActive  time.Time
+	closed      bool
+	evicted     bool
+	closeCode   int
+	closeReason string
+}
+
+// A message queued for a client. Broadcasts are marshalled and framed
+// once and shared by all of their clients.
+type Outbound struct {
+	data     []byte
+	msgType  string
+	prepared *websocket.PreparedMessage
+}
+
+// A command routed to the hub of its session.
+type HubCommand struct {
+	client      *Client
+	cmd         *Command
+	playerName  string
+	resumeToken string
+	// Host token or invite a host joins with.
+	hostToken string
+	// Whether the snapshot has the cards of the players.
+	cards bool
+	// Last event sequence the client has seen, zero for none.
+	lastSeq int64
+	// Instance running the session when it isn't this one.
+	owner string
+}
+
+type SessionHub struct {
+	game *BingoGame
+	// Hosts by their role in the session.
+	admins     map[*Client]string
+	players    map[string]*Client
+	spectators map[*Client]bool
+	events     *EventRing
+	commands   chan *HubCommand
+	calls      chan func()
+	unregister chan *Client
+	done       chan struct{}
+
+	// Name each player client joined with last.
+	playerNames map[*Client]string
+	chatRoom    *ChatRoom
+
+	// Token the owner comes back with, and when the owner left.
+	ownerToken string
+	ownerGone  time.Time
+	// Webhooks the owner subscribed to the session, and whether they
+	// changed since they were queued to the store.
+	webhooks        []*Webhook
+	webhooksChanged bool
+	// Length of the game log and owner token queued to the store last,
+	// and the saver writing them.
+	queued      int
+	queuedOwner string
+	saver       *sessionSaver
+}
+
+func NewClient(conn *websocket.Conn, role string) *Client {
+	c := &Client{conn: conn, role: role,
+		limiter:    NewClientLimiter(time.Now()),
+		send:       make(chan *Outbound, CLIENT_SEND_QUEUE),
+		lastActive: time.Now()}
+	if conn != nil {
+		c.addr = conn.RemoteAddr().String()
+	}
+	trackClient(c)
+	return c
+}
+
+func NewSessionHub(game *BingoGame) *SessionHub {
+	return &SessionHub{game: game,
+		admins:     make(map[*Client]string),
+		players:    make(map[string]*Client),
+		spectators: make(map[*Client]bool),
+		events:     NewEventRing(EVENT_RING_SIZE),
+		commands:   make(chan *HubCommand),
+		calls:      make(chan func()),
+		unregister: make(chan *Client),
+		done:       make(chan struct{}),
+
+		playerNames: make(map[*Client]string),
+		chatRoom:    NewChatRoom(),
+	}
+}
+
+// Send queues msg for the write pump without blocking. A client whose
+// queue is full is evicted. It returns false once the client is closed.
+func (c *Client) Send(msg []byte) bool {
+	return c.SendOutbound(&Outbound{data: msg})
+}
+
+func (c *Client) SendOutbound(out *Outbound) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	select {
+	case c.send <- out:
+		return true
+	default:
+	}
+	log.Println("evicting slow client:", c.role, c.addr)
+	countEviction()
+	c.closed = true
+	c.evicted = true
+	c.closeCode = websocket.CloseTryAgainLater
+	c.closeReason = ERR_SLOW_CONSUMER
+	close(c.send)
+	return false
+}
+
+func (c *Client) SendJSON(v interface{}) bool {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return c.Send(msg)
+}
+
+// Close stops the client. Queued messages are still written, followed by
+// a close frame with code and reason.
+func (c *Client) Close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
+
+func (c *Client) isEvicted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evicted
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(PING_PERIOD)
+	defer func() {
+		ticker.Stop()
+		untrackClient(c)
+		if c.ip != "" {
+			releaseConnSlot(c.ip)
+		}
+	}()
+	for {
+		select {
+		case out, ok := <-c.send:
+			if !ok || c.isEvicted() {
+				// An evicted client's backlog is dropped, the peer
+				// only gets the close frame.
+				closeConn(c.conn, c.closeCode, c.closeReason)
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			var before int64
+			if c.wire != nil {
+				before = c.wire.Written()
+			}
+			var err error
+			if out.prepared != nil {
+				err = c.conn.WritePreparedMessage(out.prepared)
+			} else {
+				err = c.conn.WriteMessage(websocket.TextMessage, out.data)
+			}
+			if err != nil {
+				c.writeFailed(err)
+				return
+			}
+			if c.wire != nil {
+				recordWrite(out, c.wire.Written()-before)
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(WRITE_WAIT))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.writeFailed(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) writeFailed(err error) {
+	log.Println(err)
+	c.conn.Close()
+	// Keep draining until the read pump notices and closes us.
+	for range c.send {
+	}
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.leaveSession()
+		c.Close(websocket.CloseNormalClosure, "")
+	}()
+
+	c.conn.SetReadDeadline(time.Now().Add(PONG_WAIT))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(PONG_WAIT))
+		return nil
+	})
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if !c.handleMessage(msg) {
+			return
+		}
+	}
+}
+
+// handleMessage parses a command sent by the client and hands it to the
+// hub of its session. It returns false once the client is closed.
+func (c *Client) handleMessage(msg []byte) bool {
+	// The read limit only applies to frames on the wire, a deflated
+	// message is checked again once inflated.
+	if int64(len(msg)) > serverConfig.ReadLimit {
+		sendError(c, nil, NewFatalError(websocket.CloseMessageTooBig, ERR_MESSAGE_TOO_BIG, "message exceeds %d bytes", serverConfig.ReadLimit))
+		return false
+	}
+	log.Println(c.role, "=> Msg:", c.addr, string(msg))
+	c.touch()
+	cmd, err := ParseCommand(msg)
+	if err == nil {
+		err = c.limiter.Allow(cmd.Type, time.Now())
+	}
+	if err == nil {
+		err = c.checkAllowed(cmd)
+	}
+	if err != nil {
+		return sendError(c, cmd, err)
+	}
+	if cmd.Type == CMD_PING {
+		return c.SendJSON(PongResp{Msg_Type: "pong"})
+	}
+	hubCmd, hub, err := c.route(cmd)
+	if err == nil && hub == nil {
+		// The session is run by another instance.
+		if c.hub != nil || c.owner != hubCmd.owner {
+			c.leaveSession()
+		}
+		if err = c.forward(hubCmd.owner, msg); err == nil {
+			return true
+		}
+	} else if err == nil && !hub.dispatch(hubCmd) {
+		err = sessionNotFound(hub.game.GameId)
+	}
+	if err != nil {
+		return sendError(c, cmd, err)
+	}
+	if c.hub != hub {
+		c.leaveSession()
+	}
+	c.hub = hub
+	return true
+}
+
+// leaveSession takes the client out of the session it joined last.
+func (c *Client) leaveSession() {
+	if c.hub != nil {
+		c.hub.leave(c)
+		c.hub = nil
+	}
+	if c.owner != "" {
+		c.leaveOwner()
+	}
+}
+
+func (c *Client) checkAllowed(cmd *Command) error {
+	switch cmd.Type {
+	case CMD_PING:
+		return nil
+	case CMD_STATUS, CMD_DRAW_NUMBER, CMD_MUTE, CMD_DELETE_MESSAGE, CMD_SLOW_MODE, CMD_INVITE, CMD_VERIFY,
+		CMD_END_SESSION, CMD_ADD_WEBHOOK, CMD_REMOVE_WEBHOOK:
+		if c.role == ROLE_ADMIN {
+			return nil
+		}
+	case CMD_CHAT:
+		if c.role == ROLE_ADMIN || c.role == ROLE_PLAYER {
+			return nil
+		}
+	case CMD_ADD_PLAYER, CMD_RESUME:
+		if c.role == ROLE_PLAYER {
+			return nil
+		}
+	case CMD_SPECTATE:
+		if c.role == ROLE_SPECTATOR {
+			return nil
+		}
+	}
+	return NewProtocolError(ERR_INVALID_COMMAND, "command %q is not allowed on the %s link", cmd.Type, c.role)
+}
+
+// route finds the hub of the session a command is addressed to, or the
+// instance running it. A status command opens the session when it isn't
+// active yet.
+func (c *Client) route(cmd *Command) (*HubCommand, *SessionHub, error) {
+	hubCmd := HubCommand{client: c, cmd: cmd}
+	var sessionId string
+	var err error
+	if cmd.Type == CMD_ADD_PLAYER {
+		var addPlayer AddPlayerPayload
+		err = cmd.DecodePayload(&addPlayer)
+		if err == nil && (addPlayer.SessionId == "" || addPlayer.PlayerName == "") {
+			err = NewProtocolError(ERR_INVALID_PAYLOAD, "%s: session_id and player_name are required", cmd.Type)
+		}
+		sessionId = addPlayer.SessionId
+		hubCmd.playerName = addPlayer.PlayerName
+	} else if cmd.Type == CMD_RESUME {
+		var resume ResumePayload
+		err = cmd.DecodePayload(&resume)
+		if err == nil && (resume.SessionId == "" || resume.ResumeToken == "") {
+			err = NewProtocolError(ERR_INVALID_PAYLOAD, "%s: session_id and resume_token are required", cmd.Type)
+		}
+		sessionId = resume.SessionId
+		hubCmd.resumeToken = resume.ResumeToken
+		hubCmd.lastSeq = resume.LastSeq
+		if hubCmd.lastSeq == 0 {
+			hubCmd.lastSeq = c.resumeSeq
+		}
+	} else {
+		var session SessionPayload
+		err = cmd.DecodePayload(&session)
+		if err == nil && session.SessionId == "" {
+			err = NewProtocolError(ERR_INVALID_PAYLOAD, "%s: missing session_id", cmd.Type)
+		}
+		sessionId = session.SessionId
+		hubCmd.lastSeq = session.LastSeq
+		hubCmd.hostToken = session.HostToken
+		hubCmd.cards = session.Cards
+	}
+	if err == nil && c.session != "" && sessionId != c.session {
+		err = NewProtocolError(ERR_INVALID_PAYLOAD, "%s: event stream is bound to session: %s", cmd.Type, c.session)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hub, owner, err := lookupSession(sessionId, cmd.Type == CMD_STATUS)
+	if err != nil {
+		return nil, nil, NewProtocolError(ERR_INTERNAL, "couldn't look up session %s: %v", sessionId, err)
+	}
+	if hub == nil && (owner == "" || c.relayed) {
+		return nil, nil, sessionNotFound(sessionId)
+	}
+	hubCmd.owner = owner
+	return &hubCmd, hub, nil
+}
+
+// OpenSessionHub returns the hub of an active session, restoring the
+// session from the store or creating it, and starting its hub when
+// needed.
+func OpenSessionHub(sessionId string) *SessionHub {
+	gamesLock.Lock()
+	b, ok := games.activeSessions[sessionId]
+	gamesLock.Unlock()
+	if ok {
+		return b.hub
+	}
+	// Left in the store by an instance that ran the session before.
+	var hub *SessionHub
+	session, err := sessionStore.Session(sessionId)
+	if err == nil && session != nil {
+		hub, err = restoredHub(session)
+	}
+	if err != nil {
+		log.Println("couldn't restore session", sessionId, err)
+	}
+
+	gamesLock.Lock()
+	defer gamesLock.Unlock()
+	if b, ok := games.activeSessions[sessionId]; ok {
+		return b.hub
+	}
+	if hub != nil {
+		startSessionHub(hub)
+		log.Println("Session restored:", sessionId, "players:", len(hub.game.GamePlayers), "draws:", hub.game.drawCount)
+		return hub
+	}
+	bGame, _ := NewBingoGame(sessionId)
+	hub = NewSessionHub(bGame)
+	hub.notify(WEBHOOK_SESSION_CREATED, WebhookData{Game_Link: bGame.GameLink})
+	startSessionHub(hub)
+	log.Println("New session created:", sessionId)
+	return hub
+}
+
+// startSessionHub makes the game of the hub active and starts the hub,
+// gamesLock has to be held.
+func startSessionHub(h *SessionHub) {
+	h.game.hub = h
+	games.activeSessions[h.game.GameId] = h.game
+	delete(games.endedSessions, h.game.GameId)
+	go h.run()
+	go h.keepLease()
+}
+
+// dispatch hands a command to the hub, false once the game is over.
+func (h *SessionHub) dispatch(hubCmd *HubCommand) bool {
+	select {
+	case h.commands <- hubCmd:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// call runs f on the hub goroutine and waits for it, false once the
+// game is over.
+func (h *SessionHub) call(f func()) bool {
+	finished := make(chan struct{})
+	select {
+	case h.calls <- func() { f(); close(finished) }:
+	case <-h.done:
+		return false
+	}
+	<-finished
+	return true
+}
+
+func (h *SessionHub) leave(c *Client) {
+	select {
+	case h.unregister <- c:
+	case <-h.done:
+	}
+}
+
+func (h *SessionHub) run() {
+	presence := time.NewTicker(PRESENCE_CHECK)
+	defer presence.Stop()
+	for {
+		select {
+		case hubCmd := <-h.commands:
+			h.handle(hubCmd)
+		case f := <-h.calls:
+			f()
+		case c := <-h.unregister:
+			h.disconnect(c)
+		case now := <-presence.C:
+			h.checkPresence(now)
+		case <-h.done:
+			h.stopSaver()
+			return
+		}
+		h.persist()
+	}
+}
+
+// disconnect drops a client whose connection has gone, players are
+// marked disconnected and keep their card for the grace period.
+func (h *SessionHub) disconnect(c *Client) {
+	if role, ok := h.admins[c]; ok {
+		delete(h.admins, c)
+		h.leaveHost(c, role)
+	}
+	delete(h.playerNames, c)
+	if h.spectators[c] {
+		delete(h.spectators, c)
+		h.countSpectators()
+	}
+	for name, pc := range h.players {
+		if pc != c {
+			continue
+		}
+		delete(h.players, name)
+		if playerSheet, ok := h.game.GamePlayers[name]; ok {
+			playerSheet.Conn = nil
+			log.Println("Admin: player disconnected:", name)
+			h.setPresence(name, playerSheet, PRESENCE_DISCONNECTED, "player_disconnected")
+		}
+	}
+}
+
+func (h *SessionHub) handle(hubCmd *HubCommand) {
+	c := hubCmd.client
+	cmd := hubCmd.cmd
+	if cmd.Type != CMD_STATUS {
+		if err := h.authorize(c, cmd); err != nil {
+			sendError(c, cmd, err)
+			return
+		}
+	}
+	switch cmd.Type {
+	case CMD_STATUS:
+		role, err := h.join(c, hubCmd.hostToken)
+		if err != nil {
+			sendError(c, cmd, err)
+			return
+		}
+		statusPayload := map[string]interface{}{"session_id": h.game.GameId,
+			"game_link":  h.game.GameLink,
+			"seq":        h.events.LastSeq(),
+			"spectators": len(h.spectators),
+			"role":       role}
+		if role == ROLE_OWNER {
+			statusPayload["host_token"] = h.ownerToken
+		}
+		sendReply(c, NewAckReply(cmd, statusPayload))
+		// A reconnecting admin that knows its last event only gets the
+		// ones it missed.
+		if hubCmd.lastSeq == 0 || !h.replay(c, hubCmd.lastSeq) {
+			h.sendSnapshot(c, hubCmd.cards)
+		}
+		h.sendChatHistory(c)
+	case CMD_DRAW_NUMBER:
+		log.Println("Draw a number for the session:", h.game.GameId)
+		dNum := DrawUniqRandNumber(h.game.draws)
+		if dNum == 0 {
+			sendError(c, cmd, NewProtocolError(ERR_ALL_DRAWN, "all numbers drawn in session %s", h.game.GameId))
+			return
+		}
+		sendReply(c, NewAckReply(cmd, nil))
+		h.drawNumber(dNum)
+	case CMD_ADD_PLAYER:
+		h.addPlayer(c, cmd, hubCmd.playerName)
+	case CMD_RESUME:
+		h.resumePlayer(c, cmd, hubCmd.resumeToken, hubCmd.lastSeq)
+	case CMD_SPECTATE:
+		h.spectate(c, cmd)
+	case CMD_CHAT:
+		h.chat(c, cmd)
+	case CMD_MUTE:
+		h.mute(c, cmd)
+	case CMD_DELETE_MESSAGE:
+		h.deleteMessage(c, cmd)
+	case CMD_SLOW_MODE:
+		h.setSlowMode(c, cmd)
+	case CMD_INVITE:
+		h.invite(c, cmd)
+	case CMD_VERIFY:
+		h.verify(c, cmd)
+	case CMD_END_SESSION:
+		log.Println("Ending the session:", h.game.GameId)
+		sendReply(c, NewAckReply(cmd, nil))
+		h.publish(AUDIENCE_ALL, WebMsgOut{Msg_Type: "session_ended"})
+		h.end("")
+	case CMD_ADD_WEBHOOK:
+		h.addWebhook(c, cmd)
+	case CMD_REMOVE_WEBHOOK:
+		h.removeWebhook(c, cmd)
+	}
+}
+
+func (h *SessionHub) addPlayer(c *Client, cmd *Command, playerName string) {
+	b := h.game
+	playerSheet, ok := b.GamePlayers[playerName]
+	if !ok {
+		b.joinPlayer(playerName, newResumeToken())
+		b.dealCard(playerName, newCard())
+		b.GamePlayers[playerName].Conn = c.conn
+	} else if h.players[playerName] != c {
+		// Only the player's own connection may re-roll, a dropped
+		// player comes back with its resume token.
+		sendError(c, cmd, NewProtocolError(ERR_NAME_TAKEN, "player name is already taken: %s", playerName))
+		return
+	} else { // deal the existing player a new sheet.
+		b.dealCard(playerName, newCard())
+		playerSheet.Conn = c.conn
+	}
+	h.setPresence(playerName, b.GamePlayers[playerName], PRESENCE_CONNECTED, "")
+	h.bindPlayer(playerName, c)
+
+	var webMsgOut WebMsgOut
+	webMsgOut.Msg_Type = "player_sheet"
+	webMsgOut.Player_Sheet = b.GamePlayers[playerName].Sheet
+	log.Printf("Reply to: %s is being sent: %d\n", c.addr, webMsgOut.Player_Sheet)
+	c.SendJSON(webMsgOut)
+	sendReply(c, NewAckReply(cmd, map[string]string{"resume_token": b.GamePlayers[playerName].resumeToken}))
+	h.sendChatHistory(c)
+
+	log.Println("Admin: update for new player is being sent:", playerName)
+	h.publish(AUDIENCE_ADMINS, WebMsgOut{Msg_Type: "new_player", Player_Name: playerName, Presence: PRESENCE_CONNECTED})
+	if !ok {
+		h.notify(WEBHOOK_PLAYER_JOINED, WebhookData{Player_Name: playerName})
+	}
+}
+
+func (h *SessionHub) drawNumber(dNum int) {
+	b := h.game
+	winners := b.drawNumber(dNum)
+
+	winnerName := ""
+	if len(winners) > 0 {
+		log.Println("Admin: found winners:", winners)
+		winnerName = winners[0]
+	}
+
+	h.publish(AUDIENCE_ALL, WebMsgOut{Msg_Type: "draw_number", Draw_Number: dNum,
+		Player_Name: winnerName, Winner: winnerName != ""})
+	for _, player := range winners {
+		h.publish(AUDIENCE_ADMINS, WebMsgOut{Msg_Type: "winner", Player_Name: player, Winner: true})
+	}
+	h.notify(WEBHOOK_DRAW, WebhookData{Draw_Number: dNum, Draws: b.drawCount})
+	for _, player := range winners {
+		h.notify(WEBHOOK_PRIZE_WON, WebhookData{Player_Name: player, Pattern: b.pattern()})
+	}
+
+	if winnerName != "" {
+		h.end(winnerName)
+	}
+}
+
+// bindPlayer makes c the connection of the player.
+func (h *SessionHub) bindPlayer(playerName string, c *Client) {
+	if oldClient, ok := h.players[playerName]; ok && oldClient != c {
+		delete(h.playerNames, oldClient)
+	}
+	h.players[playerName] = c
+	h.playerNames[c] = playerName
+}
+
+// end finishes the game, players are disconnected once their last
+// messages are written.
+func (h *SessionHub) end(winnerName string) {
+	if winnerName != "" {
+		log.Println("GAME OVER ==> WINNER:", winnerName)
+	}
+	log.Println("Killing the session", h.game.GameId)
+	h.game.endGame()
+	// The stored session is dropped once it's archived.
+	h.stopSaver()
+	archiveGame(h.game, h.ownerToken)
+	h.notify(WEBHOOK_GAME_OVER, WebhookData{Draws: h.game.drawCount, Winners: h.game.winners})
+	gamesLock.Lock()
+	delete(games.activeSessions, h.game.GameId)
+	games.endedSessions[h.game.GameId] = true
+	gamesLock.Unlock()
+
+	for _, pc := range h.players {
+		pc.Close(websocket.CloseNormalClosure, ERR_GAME_OVER)
+	}
+	h.closeSpectators()
+	close(h.done)
+}
+
+// publish numbers msg as the next session event and broadcasts it to
+// its audience. Every client gets the same frame, players find a drawn
+// number on their own card. Spectators get the updated board instead.
+func (h *SessionHub) publish(audience int, msg WebMsgOut) {
+	ev := h.events.Append(audience, msg)
+	out, err := NewBroadcast(ev.Msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if audience&AUDIENCE_ADMINS != 0 {
+		for c := range h.admins {
+			c.SendOutbound(out)
+		}
+	}
+	if audience&AUDIENCE_PLAYERS != 0 {
+		for _, pc := range h.players {
+			pc.SendOutbound(out)
+		}
+	}
+	h.updateBoard()
+}
+
+// findCell returns the position of draw on the sheet.
+func (s *BingoSheet) findCell(draw int) (int, int, bool) {
+	for col, xCol := range s.Sheet {
+		for row, rVal := range xCol {
+			if rVal == draw {
+				return col, row, true
+			}
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDrawAllNumbers(t *testing.T) {
+	b, _ := NewBingoGame("all-drawn")
+	h := NewSessionHub(b)
+	admin := NewClient(nil, ROLE_ADMIN)
+	defer untrackClient(admin)
+	h.join(admin, "")
+	for n := 1; n < 75; n++ {
+		b.drawNumber(n)
+	}
+	seq := h.events.LastSeq()
+
+	h.handle(&HubCommand{client: admin, cmd: &Command{Version: PROTOCOL_VERSION, Type: CMD_DRAW_NUMBER}})
+	if h.events.LastSeq() != seq {
+		t.Fatal("published a draw with every number drawn")
+	}
+	var reply CommandReply
+	for len(admin.send) > 0 {
+		out := <-admin.send
+		json.Unmarshal(out.data, &reply)
+	}
+	if reply.Msg_Type != REPLY_ERROR || reply.Code != ERR_ALL_DRAWN {
+		t.Fatal(reply)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+*
+* Server metrics.
+* Counters are kept in memory and served as JSON on /metrics.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+type MetricsResp struct {
+	Clients        int   `json:"clients"`
+	QueueCapacity  int   `json:"queue_capacity"`
+	QueuedMessages int   `json:"queued_messages"`
+	MaxQueueDepth  int   `json:"max_queue_depth"`
+	Evictions      int64 `json:"evictions"`
+	// Bytes on the wire against raw bytes, by msg_type.
+	Compression map[string]CompressionStats `json:"compression"`
+}
+
+// Live clients, used to sample the outbound queue depths.
+var liveClients map[*Client]bool
+var liveClientsLock sync.Mutex
+
+var evictionCount int64
+
+func trackClient(c *Client) {
+	liveClientsLock.Lock()
+	defer liveClientsLock.Unlock()
+	liveClients[c] = true
+}
+
+func untrackClient(c *Client) {
+	liveClientsLock.Lock()
+	defer liveClientsLock.Unlock()
+	delete(liveClients, c)
+}
+
+func countEviction() {
+	atomic.AddInt64(&evictionCount, 1)
+}
+
+func collectMetrics() MetricsResp {
+	metrics := MetricsResp{QueueCapacity: CLIENT_SEND_QUEUE,
+		Evictions:   atomic.LoadInt64(&evictionCount),
+		Compression: collectCompressionStats()}
+
+	liveClientsLock.Lock()
+	defer liveClientsLock.Unlock()
+	metrics.Clients = len(liveClients)
+	for c := range liveClients {
+		depth := len(c.send)
+		metrics.QueuedMessages += depth
+		if depth > metrics.MaxQueueDepth {
+			metrics.MaxQueueDepth = depth
+		}
+	}
+	return metrics
+}
+
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(collectMetrics()); err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	liveClients = make(map[*Client]bool)
+}
@@ -0,0 +1,88 @@
+/*
+*
+* Player presence.
+* Every player is connected, idle or disconnected. A player who hasn't
+* sent anything, pings included, for a while is idle. A disconnected
+* player keeps the card for a grace period to resume with, then leaves
+* the game. Changes are reported to the admins.
+*
+ */
+package main
+
+import (
+	"log"
+	"time"
+)
+
+//
+// Presence states of a player.
+//
+const (
+	PRESENCE_CONNECTED    = "connected"
+	PRESENCE_IDLE         = "idle"
+	PRESENCE_DISCONNECTED = "disconnected"
+)
+
+//
+// How often a hub checks the presence of its players.
+//
+const (
+	PRESENCE_CHECK = 5 * time.Second
+)
+
+// touch records that the client has just been active.
+func (c *Client) touch() {
+	c.mu.Lock()
+	c.lastActive = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *Client) activeSince() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastActive
+}
+
+// setPresence moves the player to presence and reports it to the admins
+// with msgType.
+func (h *SessionHub) setPresence(playerName string, playerSheet *BingoSheet, presence string, msgType string) {
+	if playerSheet.Presence == presence && presence != PRESENCE_CONNECTED {
+		return
+	}
+	playerSheet.Presence = presence
+	playerSheet.Connected = presence != PRESENCE_DISCONNECTED
+	if presence == PRESENCE_DISCONNECTED {
+		playerSheet.disconnectedAt = time.Now()
+	}
+	if msgType != "" {
+		h.publish(AUDIENCE_ADMINS, WebMsgOut{Msg_Type: msgType, Player_Name: playerName, Presence: presence})
+	}
+}
+
+// checkPresence marks players idle or active again, and drops the cards
+// of players disconnected for longer than the grace period. An owner
+// away for too long hands the session to a co-host.
+func (h *SessionHub) checkPresence(now time.Time) {
+	h.handOff(now)
+	for name, playerSheet := range h.game.GamePlayers {
+		switch playerSheet.Presence {
+		case PRESENCE_DISCONNECTED:
+			if serverConfig.PlayerGrace > 0 && now.Sub(playerSheet.disconnectedAt) > serverConfig.PlayerGrace {
+				h.game.removePlayer(name)
+				log.Println("Admin: player left:", name)
+				h.publish(AUDIENCE_ADMINS, WebMsgOut{Msg_Type: "player_left", Player_Name: name, Presence: PRESENCE_DISCONNECTED})
+			}
+		case PRESENCE_CONNECTED, PRESENCE_IDLE:
+			pc, ok := h.players[name]
+			if !ok || serverConfig.PlayerIdle <= 0 {
+				continue
+			}
+			idle := now.Sub(pc.activeSince()) > serverConfig.PlayerIdle
+			if idle && playerSheet.Presence == PRESENCE_CONNECTED {
+				h.setPresence(name, playerSheet, PRESENCE_IDLE, "player_idle")
+			} else if !idle && playerSheet.Presence == PRESENCE_IDLE {
+				h.setPresence(name, playerSheet, PRESENCE_CONNECTED, "player_active")
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+*
+* Client to server command protocol.
+* Every command sent by the admin or a player is a versioned JSON envelope
+* carrying the command type, a client chosen request id and a payload.
+* Each command is answered with an "ack" or an "error" reply echoing the
+* request id.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+)
+
+//
+// Current version of the command envelope.
+//
+const (
+	PROTOCOL_VERSION = 1
+)
+
+//
+// Command types accepted from clients.
+//
+const (
+	CMD_PING        = "ping"
+	CMD_STATUS      = "status"
+	CMD_DRAW_NUMBER = "draw_number"
+	CMD_ADD_PLAYER  = "add_player"
+	CMD_RESUME      = "resume"
+	CMD_SPECTATE    = "spectate"
+	CMD_CHAT        = "chat"
+	// Chat moderation by the hosts.
+	CMD_MUTE           = "mute"
+	CMD_DELETE_MESSAGE = "delete_message"
+	CMD_SLOW_MODE      = "slow_mode"
+	// Co-hosts.
+	CMD_INVITE = "invite"
+	CMD_VERIFY = "verify"
+	// Ends the game without a winner.
+	CMD_END_SESSION = "end_session"
+	// Webhooks of a session.
+	CMD_ADD_WEBHOOK    = "add_webhook"
+	CMD_REMOVE_WEBHOOK = "remove_webhook"
+)
+
+//
+// Reply types sent back for each command.
+//
+const (
+	REPLY_ACK   = "ack"
+	REPLY_ERROR = "error"
+)
+
+type Command struct {
+	Version   int             `json:"v"`
+	Type      string          `json:"type"`
+	RequestId string          `json:"request_id"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// Payload of status, draw_number and spectate commands.
+type SessionPayload struct {
+	SessionId string `json:"session_id"`
+	// Last event sequence seen by a reconnecting admin.
+	LastSeq int64 `json:"last_seq,omitempty"`
+	// Host token of the owner or an invite, for status.
+	HostToken string `json:"host_token,omitempty"`
+	// Whether the snapshot sent for status has the players' cards.
+	Cards bool `json:"cards,omitempty"`
+}
+
+// Payload of add_player command.
+type AddPlayerPayload struct {
+	SessionId  string `json:"session_id"`
+	PlayerName string `json:"player_name"`
+}
+
+type CommandReply struct {
+	Msg_Type  string      `json:"msg_type"`
+	RequestId string      `json:"request_id"`
+	Command   string      `json:"command"`
+	Code      string      `json:"code,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+}
+
+// ParseCommand decodes and validates a command envelope.
+// A bare "ping" text is still accepted from older clients.
+func ParseCommand(msg []byte) (*Command, error) {
+	if string(msg) == "ping" {
+		return &Command{Version: PROTOCOL_VERSION, Type: CMD_PING}, nil
+	}
+
+	var cmd Command
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return nil, NewProtocolError(ERR_INVALID_COMMAND, "malformed command: %v", err)
+	}
+	if cmd.Version != PROTOCOL_VERSION {
+		return &cmd, NewFatalError(websocket.CloseUnsupportedData, ERR_UNSUPPORTED, "unsupported protocol version: %d", cmd.Version)
+	}
+	switch cmd.Type {
+	case CMD_PING, CMD_STATUS, CMD_DRAW_NUMBER, CMD_ADD_PLAYER, CMD_RESUME, CMD_SPECTATE,
+		CMD_CHAT, CMD_MUTE, CMD_DELETE_MESSAGE, CMD_SLOW_MODE, CMD_INVITE, CMD_VERIFY,
+		CMD_END_SESSION, CMD_ADD_WEBHOOK, CMD_REMOVE_WEBHOOK:
+	default:
+		return &cmd, NewProtocolError(ERR_INVALID_COMMAND, "unknown command type: %q", cmd.Type)
+	}
+	return &cmd, nil
+}
+
+// DecodePayload unmarshals the command payload into v.
+func (c *Command) DecodePayload(v interface{}) error {
+	if len(c.Payload) == 0 {
+		return NewProtocolError(ERR_INVALID_PAYLOAD, "%s: missing payload", c.Type)
+	}
+	if err := json.Unmarshal(c.Payload, v); err != nil {
+		return NewProtocolError(ERR_INVALID_PAYLOAD, "%s: malformed payload: %v", c.Type, err)
+	}
+	return nil
+}
+
+func NewAckReply(cmd *Command, payload interface{}) *CommandReply {
+	return &CommandReply{Msg_Type: REPLY_ACK, RequestId: cmd.RequestId, Command: cmd.Type, Payload: payload}
+}
+
+func NewErrorReply(cmd *Command, err error) *CommandReply {
+	pErr := asProtocolError(err)
+	reply := CommandReply{Msg_Type: REPLY_ERROR, Code: pErr.Code, Error: pErr.Message}
+	if cmd != nil {
+		reply.RequestId = cmd.RequestId
+		reply.Command = cmd.Type
+	}
+	return &reply
+}
+
+// sendReply queues a command reply for the client.
+func sendReply(c *Client, reply *CommandReply) bool {
+	return c.SendJSON(reply)
+}
@@ -0,0 +1,188 @@
+/*
+*
+* Rate limiting.
+* Every connection has a token bucket per command type and one for all
+* of its commands. A throttled command gets an error frame and costs a
+* strike; a client that runs out of strikes is disconnected. The number
+* of concurrent websockets per IP is capped as well. REST requests count
+* against the limits of their remote IP, as the commands of one
+* connection.
+*
+ */
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RateLimit struct {
+	// Tokens added per second and bucket size.
+	Rate  float64
+	Burst float64
+}
+
+//
+// Time after which the limits of an IP without REST requests are
+// dropped, their buckets are full again by then.
+//
+const (
+	API_LIMITER_IDLE = 10 * time.Minute
+)
+
+//
+// Per command limits, commands not listed only count against the
+// connection's overall limit.
+//
+var commandLimits = map[string]RateLimit{
+	CMD_PING:           {Rate: 1, Burst: 5},
+	CMD_STATUS:         {Rate: 1, Burst: 3},
+	CMD_DRAW_NUMBER:    {Rate: 2, Burst: 5},
+	CMD_ADD_PLAYER:     {Rate: 0.5, Burst: 3},
+	CMD_RESUME:         {Rate: 0.5, Burst: 3},
+	CMD_SPECTATE:       {Rate: 0.5, Burst: 3},
+	CMD_CHAT:           {Rate: 1, Burst: 5},
+	CMD_INVITE:         {Rate: 0.2, Burst: 5},
+	CMD_VERIFY:         {Rate: 1, Burst: 5},
+	CMD_END_SESSION:    {Rate: 0.2, Burst: 1},
+	CMD_ADD_WEBHOOK:    {Rate: 0.2, Burst: 5},
+	CMD_REMOVE_WEBHOOK: {Rate: 0.2, Burst: 5},
+}
+
+type TokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(limit RateLimit, now time.Time) *TokenBucket {
+	return &TokenBucket{limit: limit, tokens: limit.Burst, last: now}
+}
+
+// Allow takes a token when one is available.
+func (b *TokenBucket) Allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > b.limit.Burst {
+		b.tokens = b.limit.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ClientLimiter is only used by the client's read pump.
+type ClientLimiter struct {
+	overall  *TokenBucket
+	commands map[string]*TokenBucket
+	// A strike is taken for every throttled command.
+	strikes *TokenBucket
+}
+
+func NewClientLimiter(now time.Time) *ClientLimiter {
+	return &ClientLimiter{
+		overall:  NewTokenBucket(serverConfig.CommandLimit, now),
+		commands: make(map[string]*TokenBucket),
+		strikes:  NewTokenBucket(serverConfig.StrikeLimit, now),
+	}
+}
+
+// Allow checks a command against the limits. Throttled commands are
+// reported with a rate_limited error, fatal once the strikes are gone.
+func (l *ClientLimiter) Allow(cmdType string, now time.Time) error {
+	allowed := l.overall.Allow(now)
+	if limit, ok := commandLimits[cmdType]; ok && allowed {
+		bucket, ok := l.commands[cmdType]
+		if !ok {
+			bucket = NewTokenBucket(limit, now)
+			l.commands[cmdType] = bucket
+		}
+		allowed = bucket.Allow(now)
+	}
+	if allowed {
+		return nil
+	}
+	if !l.strikes.Allow(now) {
+		return NewFatalError(websocket.ClosePolicyViolation, ERR_RATE_LIMITED, "too many throttled commands")
+	}
+	return NewProtocolError(ERR_RATE_LIMITED, "too many %s commands, slow down", cmdType)
+}
+
+// Open websockets by remote IP.
+var connsPerIP map[string]int
+var connsPerIPLock sync.Mutex
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// acquireConnSlot reserves a websocket for ip, false when it already has
+// as many as allowed.
+func acquireConnSlot(ip string) bool {
+	connsPerIPLock.Lock()
+	defer connsPerIPLock.Unlock()
+	if serverConfig.MaxConnsPerIP > 0 && connsPerIP[ip] >= serverConfig.MaxConnsPerIP {
+		return false
+	}
+	connsPerIP[ip]++
+	return true
+}
+
+func releaseConnSlot(ip string) {
+	connsPerIPLock.Lock()
+	defer connsPerIPLock.Unlock()
+	if connsPerIP[ip] <= 1 {
+		delete(connsPerIP, ip)
+		return
+	}
+	connsPerIP[ip]--
+}
+
+// Limiters of the REST requests by remote IP.
+var apiLimiters map[string]*apiLimiter
+var apiLimitersLock sync.Mutex
+var apiLimitersSwept time.Time
+
+type apiLimiter struct {
+	*ClientLimiter
+	used time.Time
+}
+
+// limitAPI checks a REST request running cmdType against the limits of
+// its remote IP. Reads pass no command and only count against the
+// overall limit.
+func limitAPI(r *http.Request, cmdType string) error {
+	now := time.Now()
+	ip := remoteIP(r)
+	apiLimitersLock.Lock()
+	defer apiLimitersLock.Unlock()
+	if now.Sub(apiLimitersSwept) > API_LIMITER_IDLE {
+		for key, l := range apiLimiters {
+			if now.Sub(l.used) > API_LIMITER_IDLE {
+				delete(apiLimiters, key)
+			}
+		}
+		apiLimitersSwept = now
+	}
+	l, ok := apiLimiters[ip]
+	if !ok {
+		l = &apiLimiter{ClientLimiter: NewClientLimiter(now)}
+		apiLimiters[ip] = l
+	}
+	l.used = now
+	return l.Allow(cmdType, now)
+}
+
+func init() {
+	connsPerIP = make(map[string]int)
+	apiLimiters = make(map[string]*apiLimiter)
+}
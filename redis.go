@@ -0,0 +1,267 @@
+/*
+*
+* Redis broker.
+* A minimal client of the redis protocol (RESP), enough for PUBLISH,
+* SUBSCRIBE and the claims kept as expiring keys. Claims are checked and
+* set by Lua scripts so two instances never own the same key.
+*
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Redis connection timeouts.
+//
+const (
+	REDIS_DIAL_TIMEOUT = 5 * time.Second
+	REDIS_TIMEOUT      = 5 * time.Second
+)
+
+// Sets the claim when the key is free or renews it for its owner,
+// returns the owner.
+const redisClaimScript = `
+local owner = redis.call('GET', KEYS[1])
+if not owner then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return ARGV[1]
+end
+if owner == ARGV[1] then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return owner`
+
+const redisReleaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+// An error reply of the server, the connection is still usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+type RedisBroker struct {
+	addr     string
+	password string
+
+	// Connection for commands, subscriptions have their own.
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type redisSubscription struct {
+	conn     net.Conn
+	messages chan []byte
+}
+
+func DialRedisBroker(addr string, password string) (*RedisBroker, error) {
+	b := &RedisBroker{addr: addr, password: password}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.dial(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *RedisBroker) dial() error {
+	conn, r, err := dialRedis(b.addr, b.password)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.r = r
+	return nil
+}
+
+func dialRedis(addr string, password string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", addr, REDIS_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if password != "" {
+		conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+		if _, err := redisRoundTrip(conn, r, "AUTH", password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, r, nil
+}
+
+// do sends a command and reads its reply. A broken connection is dialed
+// again once.
+func (b *RedisBroker) do(args ...string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if b.conn == nil {
+			if err := b.dial(); err != nil {
+				return nil, err
+			}
+		}
+		b.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+		reply, err := redisRoundTrip(b.conn, b.r, args...)
+		if _, ok := err.(redisError); err == nil || ok {
+			return reply, err
+		}
+		b.conn.Close()
+		b.conn = nil
+		if attempt > 0 {
+			return nil, err
+		}
+		log.Println("redis connection lost, dialing again:", err)
+	}
+}
+
+func redisRoundTrip(w io.Writer, r *bufio.Reader, args ...string) (interface{}, error) {
+	if err := writeRedisCommand(w, args); err != nil {
+		return nil, err
+	}
+	return readRedisReply(r)
+}
+
+func writeRedisCommand(w io.Writer, args []string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRedisReply reads one reply: a string, an int64, nil, a redisError
+// or a slice of replies.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readRedisReply(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				replies[i] = err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("redis: malformed reply: %q", line)
+}
+
+func (b *RedisBroker) Publish(topic string, msg []byte) error {
+	_, err := b.do("PUBLISH", topic, string(msg))
+	return err
+}
+
+func (b *RedisBroker) Subscribe(topic string) (Subscription, error) {
+	conn, r, err := dialRedis(b.addr, b.password)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+	if _, err := redisRoundTrip(conn, r, "SUBSCRIBE", topic); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	s := &redisSubscription{conn: conn, messages: make(chan []byte, BROKER_QUEUE)}
+	go s.read(r)
+	return s, nil
+}
+
+func (b *RedisBroker) Claim(key string, instance string, ttl time.Duration) (string, error) {
+	reply, err := b.do("EVAL", redisClaimScript, "1", key, instance, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return "", err
+	}
+	owner, _ := reply.(string)
+	return owner, nil
+}
+
+func (b *RedisBroker) Owner(key string) (string, error) {
+	reply, err := b.do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	owner, _ := reply.(string)
+	return owner, nil
+}
+
+func (b *RedisBroker) Release(key string, instance string) error {
+	_, err := b.do("EVAL", redisReleaseScript, "1", key, instance)
+	return err
+}
+
+func (s *redisSubscription) read(r *bufio.Reader) {
+	defer close(s.messages)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			log.Println("redis subscription:", err)
+			return
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		if payload, ok := msg[2].(string); ok {
+			s.messages <- []byte(payload)
+		}
+	}
+}
+
+func (s *redisSubscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+func (s *redisSubscription) Close() error {
+	return s.conn.Close()
+}
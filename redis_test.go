@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+func TestRedisBroker(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+	if _, err := NewBroker("redis://:wrong@" + mr.Addr()); err == nil {
+		t.Fatal("connected with a wrong password")
+	}
+	b, err := NewBroker("redis://:secret@" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := b.Subscribe("topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	for _, msg := range []string{"one", "two\r\nlines", ""} {
+		if err := b.Publish("topic", []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-sub.Messages():
+			if string(got) != msg {
+				t.Fatalf("got %q, want %q", got, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	claims := []struct {
+		instance string
+		owner    string
+	}{
+		{"a", "a"},
+		{"b", "a"},
+		// Renewed by its owner.
+		{"a", "a"},
+	}
+	for _, c := range claims {
+		if owner, err := b.Claim("lease", c.instance, time.Minute); err != nil || owner != c.owner {
+			t.Fatalf("claim of %s: %q %v, want %q", c.instance, owner, err, c.owner)
+		}
+	}
+	if owner, err := b.Owner("lease"); err != nil || owner != "a" {
+		t.Fatal(owner, err)
+	}
+	if ttl := mr.TTL("lease"); ttl <= 0 || ttl > time.Minute {
+		t.Fatal("lease ttl", ttl)
+	}
+	if err := b.Release("lease", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := b.Owner("lease"); owner != "a" {
+		t.Fatal("released by another instance:", owner)
+	}
+	if err := b.Release("lease", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := b.Owner("lease"); owner != "" {
+		t.Fatal("not released:", owner)
+	}
+
+	// A lease that isn't renewed expires.
+	b.Claim("lease", "b", time.Second)
+	mr.FastForward(2 * time.Second)
+	if owner, _ := b.Claim("lease", "a", time.Minute); owner != "a" {
+		t.Fatal("expired lease kept by", owner)
+	}
+}
+
+// startInstance runs bin on a free port with the broker at redisAddr and
+// returns its websocket base url.
+func startInstance(t *testing.T, bin string, id string, redisAddr string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	cmd := exec.Command(bin, "-listen", addr, "-broker", "redis://"+redisAddr, "-instance-id", id)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get("http://" + addr + "/status"); err == nil {
+			resp.Body.Close()
+			return "ws://" + addr
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("instance didn't start:", id)
+	return ""
+}
+
+// dialInstance opens a websocket on path with a ticket for role.
+func dialInstance(t *testing.T, base string, path string, role string) *websocket.Conn {
+	resp, err := http.Get("http" + base[len("ws"):] + "/ticket?role=" + role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ticket TicketResp
+	json.NewDecoder(resp.Body).Decode(&ticket)
+	resp.Body.Close()
+	conn, _, err := websocket.DefaultDialer.Dial(base+path+"?ticket="+ticket.Ticket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func sendCommand(t *testing.T, conn *websocket.Conn, cmdType string, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	msg, _ := json.Marshal(Command{Version: PROTOCOL_VERSION, Type: cmdType, RequestId: cmdType, Payload: data})
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readMessage returns the next message of msgType, raw and decoded.
+func readMessage(t *testing.T, conn *websocket.Conn, msgType string) ([]byte, map[string]interface{}) {
+	for i := 0; i < 200; i++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]interface{}
+		json.Unmarshal(data, &msg)
+		if msg["msg_type"] == msgType {
+			return data, msg
+		}
+	}
+	t.Fatal("no message:", msgType)
+	return nil, nil
+}
+
+func TestRedisCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs two instances")
+	}
+	mr := miniredis.RunT(t)
+	bin := filepath.Join(t.TempDir(), "bingo")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+	a := startInstance(t, bin, "a", mr.Addr())
+	b := startInstance(t, bin, "b", mr.Addr())
+
+	admin := dialInstance(t, a, "/gamelink", ROLE_ADMIN)
+	sendCommand(t, admin, CMD_STATUS, SessionPayload{SessionId: "shared"})
+	readMessage(t, admin, REPLY_ACK)
+	if owner, _ := mr.Get(sessionKey("shared")); owner != "a" {
+		t.Fatal("session owned by", owner)
+	}
+
+	// A player on each instance.
+	one := dialInstance(t, a, "/playersdraw", ROLE_PLAYER)
+	sendCommand(t, one, CMD_ADD_PLAYER, map[string]string{"session_id": "shared", "player_name": "one"})
+	readMessage(t, one, REPLY_ACK)
+	two := dialInstance(t, b, "/playersdraw", ROLE_PLAYER)
+	sendCommand(t, two, CMD_ADD_PLAYER, map[string]string{"session_id": "shared", "player_name": "two"})
+	readMessage(t, two, "player_sheet")
+	readMessage(t, two, REPLY_ACK)
+	// Names are taken across instances.
+	other := dialInstance(t, b, "/playersdraw", ROLE_PLAYER)
+	sendCommand(t, other, CMD_ADD_PLAYER, map[string]string{"session_id": "shared", "player_name": "one"})
+	if _, msg := readMessage(t, other, REPLY_ERROR); msg["code"] != ERR_NAME_TAKEN {
+		t.Fatal(msg)
+	}
+
+	// Both players get the same event stream, byte for byte. The draws
+	// stay within the burst the instance allows.
+	for i := 0; i < 5; i++ {
+		sendCommand(t, admin, CMD_DRAW_NUMBER, SessionPayload{SessionId: "shared"})
+		fromA, msg := readMessage(t, one, "draw_number")
+		fromB, _ := readMessage(t, two, "draw_number")
+		if string(fromA) != string(fromB) {
+			t.Fatalf("instances sent different events:\n%s\n%s", fromA, fromB)
+		}
+		if msg["winner"] == true {
+			break
+		}
+	}
+}
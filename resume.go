@@ -0,0 +1,136 @@
+/*
+*
+* Player resume.
+* Every player gets an opaque resume token when joining. A player whose
+* connection dropped reconnects with the token and is bound back to the
+* same BingoSheet instead of getting a new one.
+*
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/websocket"
+	"log"
+)
+
+//
+// Game states reported to resuming players and spectators.
+//
+const (
+	GAME_WAITING     = "waiting"
+	GAME_IN_PROGRESS = "in_progress"
+	GAME_OVER        = "game_over"
+)
+
+// Payload of resume command.
+type ResumePayload struct {
+	SessionId   string `json:"session_id"`
+	ResumeToken string `json:"resume_token"`
+	LastSeq     int64  `json:"last_seq,omitempty"`
+}
+
+// Everything a resuming player needs to rebuild its page.
+type ResumeState struct {
+	Msg_Type     string   `json:"msg_type"`
+	Player_Name  string   `json:"player_name"`
+	Player_Sheet [][]int  `json:"player_sheet"`
+	Draws        []int    `json:"draws"`
+	Marks        [][]bool `json:"marks"`
+	Game_State   string   `json:"game_state"`
+	Seq          int64    `json:"seq"`
+}
+
+func newResumeToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Panic(err)
+	}
+	return hex.EncodeToString(token)
+}
+
+// drawnNumbers returns the numbers drawn so far in draw order.
+func (b *BingoGame) drawnNumbers() []int {
+	drawn := make([]int, b.drawCount)
+	copy(drawn, b.draws[:b.drawCount])
+	return drawn
+}
+
+func (b *BingoGame) state() string {
+	if len(b.winners) > 0 || b.ended {
+		return GAME_OVER
+	}
+	if b.drawCount == 0 {
+		return GAME_WAITING
+	}
+	return GAME_IN_PROGRESS
+}
+
+// marks flags every cell of the sheet that has been drawn since it was
+// dealt.
+func (s *BingoSheet) marks(draws []int) [][]bool {
+	drawn := make(map[int]bool)
+	if s.dealtAt < len(draws) {
+		draws = draws[s.dealtAt:]
+	} else {
+		draws = nil
+	}
+	for _, d := range draws {
+		drawn[d] = true
+	}
+	marks := make([][]bool, len(s.Sheet))
+	for i, col := range s.Sheet {
+		marks[i] = make([]bool, len(col))
+		for j, val := range col {
+			marks[i][j] = drawn[val]
+		}
+	}
+	return marks
+}
+
+func (h *SessionHub) findPlayerByToken(token string) (string, *BingoSheet) {
+	if token == "" {
+		return "", nil
+	}
+	for name, playerSheet := range h.game.GamePlayers {
+		if hmac.Equal([]byte(playerSheet.resumeToken), []byte(token)) {
+			return name, playerSheet
+		}
+	}
+	return "", nil
+}
+
+// resumePlayer binds c to the sheet the token was issued for. A client
+// that knows its last seen event only gets the events it missed, others
+// get the card, the draws so far and the marks.
+func (h *SessionHub) resumePlayer(c *Client, cmd *Command, token string, lastSeq int64) {
+	playerName, playerSheet := h.findPlayerByToken(token)
+	if playerSheet == nil {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_TOKEN, "unknown resume token for session: %s", h.game.GameId))
+		return
+	}
+	if oldClient, ok := h.players[playerName]; ok && oldClient != c {
+		oldClient.Close(websocket.CloseNormalClosure, "resumed on another connection")
+	}
+	h.bindPlayer(playerName, c)
+	playerSheet.Conn = c.conn
+
+	if lastSeq == 0 || !h.replay(c, lastSeq) {
+		draws := h.game.drawnNumbers()
+		c.SendJSON(ResumeState{Msg_Type: "resume_state",
+			Player_Name:  playerName,
+			Player_Sheet: playerSheet.Sheet,
+			Draws:        draws,
+			Marks:        playerSheet.marks(draws),
+			Game_State:   h.game.state(),
+			Seq:          h.events.LastSeq(),
+		})
+	}
+	sendReply(c, NewAckReply(cmd, nil))
+	h.sendChatHistory(c)
+
+	log.Println("Admin: player resumed:", playerName)
+	h.setPresence(playerName, playerSheet, PRESENCE_CONNECTED, "player_rejoined")
+}
@@ -0,0 +1,255 @@
+/*
+*
+* Session roles.
+* Hosts connect over the admin link and get their role in a session when
+* they join it with status. The first host of a session owns it and is
+* given a host token to come back with, co-hosts join with an invite the
+* owner signed for their role. Every command is checked against the
+* roles allowed to run it. When the owner stays away, ownership is
+* handed to a co-host.
+*
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// Roles of the hosts of a session, players and spectators keep the role
+// of their link.
+//
+const (
+	ROLE_OWNER     = "owner"
+	ROLE_CALLER    = "caller"
+	ROLE_VERIFIER  = "verifier"
+	ROLE_MODERATOR = "moderator"
+)
+
+// Session roles allowed to run each command. Hosts join with status.
+var commandRoles = map[string][]string{
+	CMD_STATUS:         {ROLE_OWNER, ROLE_CALLER, ROLE_VERIFIER, ROLE_MODERATOR},
+	CMD_DRAW_NUMBER:    {ROLE_OWNER, ROLE_CALLER},
+	CMD_VERIFY:         {ROLE_OWNER, ROLE_CALLER, ROLE_VERIFIER},
+	CMD_INVITE:         {ROLE_OWNER},
+	CMD_END_SESSION:    {ROLE_OWNER},
+	CMD_ADD_WEBHOOK:    {ROLE_OWNER},
+	CMD_REMOVE_WEBHOOK: {ROLE_OWNER},
+	CMD_MUTE:           {ROLE_OWNER, ROLE_MODERATOR},
+	CMD_DELETE_MESSAGE: {ROLE_OWNER, ROLE_MODERATOR},
+	CMD_SLOW_MODE:      {ROLE_OWNER, ROLE_MODERATOR},
+	CMD_CHAT:           {ROLE_OWNER, ROLE_CALLER, ROLE_VERIFIER, ROLE_MODERATOR, ROLE_PLAYER},
+	CMD_ADD_PLAYER:     {ROLE_PLAYER},
+	CMD_RESUME:         {ROLE_PLAYER},
+	CMD_SPECTATE:       {ROLE_SPECTATOR},
+}
+
+// Co-hosts the ownership is handed to, in order of preference.
+var successorRoles = []string{ROLE_CALLER, ROLE_MODERATOR, ROLE_VERIFIER}
+
+// Payload of invite command.
+type InvitePayload struct {
+	SessionId string `json:"session_id"`
+	Role      string `json:"role"`
+}
+
+// Payload of verify command.
+type VerifyPayload struct {
+	SessionId  string `json:"session_id"`
+	PlayerName string `json:"player_name"`
+}
+
+// Sent to a host whose role changed.
+type HostRole struct {
+	Msg_Type   string `json:"msg_type"`
+	Role       string `json:"role"`
+	Host_Token string `json:"host_token,omitempty"`
+}
+
+// sessionRole returns the role of c in the session, empty for a host that
+// hasn't joined.
+func (h *SessionHub) sessionRole(c *Client) string {
+	if c.role == ROLE_ADMIN {
+		return h.admins[c]
+	}
+	return c.role
+}
+
+// authorize checks the role of c in the session may run cmd.
+func (h *SessionHub) authorize(c *Client, cmd *Command) error {
+	role := h.sessionRole(c)
+	if role == "" {
+		return NewProtocolError(ERR_FORBIDDEN, "join session %s with status before %s", h.game.GameId, cmd.Type)
+	}
+	for _, allowed := range commandRoles[cmd.Type] {
+		if role == allowed {
+			return nil
+		}
+	}
+	return NewProtocolError(ERR_FORBIDDEN, "the %s of session %s may not %s", role, h.game.GameId, cmd.Type)
+}
+
+// tokenRole returns the host role a token gives in the session, without
+// joining it.
+func (h *SessionHub) tokenRole(token string) (string, error) {
+	if token != "" && hmac.Equal([]byte(token), []byte(h.ownerToken)) {
+		return ROLE_OWNER, nil
+	}
+	return RedeemInvite(token, h.game.GameId, time.Now())
+}
+
+// join gives c its host role in the session. The first host owns the
+// session, later ones need the host token of the owner or an invite.
+func (h *SessionHub) join(c *Client, token string) (string, error) {
+	if role := h.admins[c]; role != "" {
+		return role, nil
+	}
+	var role string
+	switch {
+	case h.ownerToken == "":
+		h.ownerToken = newResumeToken()
+		role = ROLE_OWNER
+	case token == "":
+		return "", NewProtocolError(ERR_FORBIDDEN, "session %s already has an owner, join with an invite", h.game.GameId)
+	case hmac.Equal([]byte(token), []byte(h.ownerToken)):
+		role = ROLE_OWNER
+	default:
+		var err error
+		if role, err = RedeemInvite(token, h.game.GameId, time.Now()); err != nil {
+			return "", NewProtocolError(ERR_INVALID_TOKEN, "%v", err)
+		}
+	}
+	if role == ROLE_OWNER && !c.request {
+		h.ownerGone = time.Time{}
+	}
+	h.admins[c] = role
+	log.Println("Admin: host joined", h.game.GameId, "as", role, c.addr)
+	return role, nil
+}
+
+// leaveHost notes when the last connection of the owner has gone. REST
+// requests don't count as connections of the owner.
+func (h *SessionHub) leaveHost(c *Client, role string) {
+	if role != ROLE_OWNER || c.request {
+		return
+	}
+	for other, r := range h.admins {
+		if r == ROLE_OWNER && !other.request {
+			return
+		}
+	}
+	h.ownerGone = time.Now()
+}
+
+// handOff makes a co-host the owner once the owner has been away for the
+// grace period. The old host token stops working.
+func (h *SessionHub) handOff(now time.Time) {
+	if h.ownerGone.IsZero() || now.Sub(h.ownerGone) <= serverConfig.OwnerGrace {
+		return
+	}
+	for _, role := range successorRoles {
+		for c, r := range h.admins {
+			if r != role || c.request {
+				continue
+			}
+			h.admins[c] = ROLE_OWNER
+			h.ownerToken = newResumeToken()
+			h.ownerGone = time.Time{}
+			log.Println("Admin: ownership of", h.game.GameId, "handed to", role, c.addr)
+			c.SendJSON(HostRole{Msg_Type: "host_role", Role: ROLE_OWNER, Host_Token: h.ownerToken})
+			for other := range h.admins {
+				if other != c {
+					other.SendJSON(HostRole{Msg_Type: "owner_changed", Role: role})
+				}
+			}
+			return
+		}
+	}
+}
+
+// invite signs an invite to the session for a co-host role.
+func (h *SessionHub) invite(c *Client, cmd *Command) {
+	var payload InvitePayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	if payload.Role != ROLE_CALLER && payload.Role != ROLE_VERIFIER && payload.Role != ROLE_MODERATOR {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "can't invite a %q, only a caller, verifier or moderator", payload.Role))
+		return
+	}
+	invite, expires := IssueInvite(h.game.GameId, payload.Role, time.Now())
+	log.Println("Admin: invite issued for", h.game.GameId, "as", payload.Role)
+	sendReply(c, NewAckReply(cmd, map[string]interface{}{"invite": invite,
+		"role":    payload.Role,
+		"link":    "/?session=" + url.QueryEscape(h.game.GameId) + "&invite=" + url.QueryEscape(invite),
+		"expires": expires.Unix()}))
+}
+
+// verify shows the card of a player and its drawn cells, so a claim can
+// be checked.
+func (h *SessionHub) verify(c *Client, cmd *Command) {
+	var payload VerifyPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	playerSheet, ok := h.game.GamePlayers[payload.PlayerName]
+	if !ok {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "no player named: %s", payload.PlayerName))
+		return
+	}
+	marks := playerSheet.marks(h.game.drawnNumbers())
+	complete := true
+	for i, col := range playerSheet.Sheet {
+		for j, val := range col {
+			if val != -1 && !marks[i][j] {
+				complete = false
+			}
+		}
+	}
+	sendReply(c, NewAckReply(cmd, map[string]interface{}{"player_name": payload.PlayerName,
+		"player_sheet": playerSheet.Sheet,
+		"marks":        marks,
+		"pattern":      h.game.pattern(),
+		"complete":     complete}))
+}
+
+// IssueInvite returns an invite to a session for role as
+// role.expires.session.signature, the session hex encoded.
+func IssueInvite(sessionId string, role string, now time.Time) (string, time.Time) {
+	expires := now.Add(serverConfig.InviteTTL)
+	payload := role + "." + strconv.FormatInt(expires.Unix(), 10) + "." + hex.EncodeToString([]byte(sessionId))
+	return payload + "." + signTicket("invite."+payload), expires
+}
+
+// RedeemInvite checks an invite was signed by us for the session and
+// returns its role. Invites can be used until they expire.
+func RedeemInvite(invite string, sessionId string, now time.Time) (string, error) {
+	parts := strings.Split(invite, ".")
+	if len(parts) != 4 {
+		return "", fmt.Errorf("malformed invite")
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(signTicket("invite."+payload)), []byte(parts[3])) {
+		return "", fmt.Errorf("bad invite signature")
+	}
+	if parts[2] != hex.EncodeToString([]byte(sessionId)) {
+		return "", fmt.Errorf("invite issued for another session")
+	}
+	expiresUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed invite expiry")
+	}
+	if now.After(time.Unix(expiresUnix, 0)) {
+		return "", fmt.Errorf("invite expired")
+	}
+	return parts[0], nil
+}
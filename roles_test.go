@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOwnerPresence(t *testing.T) {
+	game, _ := NewBingoGame("roles")
+	h := NewSessionHub(game)
+	invite, _ := IssueInvite("roles", ROLE_CALLER, time.Now())
+
+	// The owner drives the session over REST only.
+	request := NewClient(nil, ROLE_ADMIN)
+	request.request = true
+	if role, err := h.join(request, ""); err != nil || role != ROLE_OWNER {
+		t.Fatal(role, err)
+	}
+	ownerToken := h.ownerToken
+	h.disconnect(request)
+	caller := NewClient(nil, ROLE_ADMIN)
+	if role, err := h.join(caller, invite); err != nil || role != ROLE_CALLER {
+		t.Fatal(role, err)
+	}
+	for i := 0; i < 3; i++ {
+		request = NewClient(nil, ROLE_ADMIN)
+		request.request = true
+		h.join(request, ownerToken)
+		h.disconnect(request)
+	}
+	h.handOff(time.Now().Add(serverConfig.OwnerGrace + time.Minute))
+	if h.ownerToken != ownerToken || h.admins[caller] != ROLE_CALLER {
+		t.Fatal("ownership handed off while the owner used REST")
+	}
+
+	// A REST request of a co-host doesn't take over from an owner that
+	// left, the connected co-host does.
+	owner := NewClient(nil, ROLE_ADMIN)
+	h.join(owner, ownerToken)
+	request = NewClient(nil, ROLE_ADMIN)
+	request.request = true
+	h.join(request, invite)
+	h.disconnect(owner)
+	if h.ownerGone.IsZero() {
+		t.Fatal("owner leaving wasn't noted")
+	}
+	h.handOff(time.Now().Add(serverConfig.OwnerGrace + time.Minute))
+	if h.ownerToken == ownerToken || h.admins[caller] != ROLE_OWNER || h.admins[request] != ROLE_CALLER {
+		t.Fatal("ownership wasn't handed to the connected co-host")
+	}
+}
@@ -0,0 +1,334 @@
+/*
+*
+* API descriptions.
+* JSON Schemas of every websocket message and an OpenAPI document of the
+* HTTP routes are generated from the Go types when first asked for, and
+* served at /schemas/websocket.json and /openapi.json.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// JSON Schema dialect of the documents, OpenAPI 3.1 uses the same one.
+//
+const (
+	SCHEMA_DIALECT  = "https://json-schema.org/draft/2020-12/schema"
+	OPENAPI_VERSION = "3.1.0"
+)
+
+// Types of the messages sent to clients, by msg_type.
+var serverMessages = map[string]interface{}{
+	REPLY_ACK:             CommandReply{},
+	REPLY_ERROR:           CommandReply{},
+	"pong":                PongResp{},
+	"player_sheet":        WebMsgOut{},
+	"draw_number":         WebMsgOut{},
+	"winner":              WebMsgOut{},
+	"new_player":          WebMsgOut{},
+	"player_disconnected": WebMsgOut{},
+	"player_rejoined":     WebMsgOut{},
+	"player_idle":         WebMsgOut{},
+	"player_active":       WebMsgOut{},
+	"player_left":         WebMsgOut{},
+	"session_ended":       WebMsgOut{},
+	"resume_state":        ResumeState{},
+	"session_snapshot":    SessionSnapshot{},
+	"board":               CallerBoard{},
+	"spectators":          SpectatorCount{},
+	"chat":                ChatMessage{},
+	"chat_history":        ChatHistory{},
+	"chat_muted":          ChatNotice{},
+	"chat_deleted":        ChatNotice{},
+	"chat_slow_mode":      ChatNotice{},
+	"host_role":           HostRole{},
+	"owner_changed":       HostRole{},
+	"stream":              StreamOpened{},
+	"stream_closed":       StreamClosed{},
+	"server_shutdown":     WebMsgOut{},
+}
+
+// Payload types of the commands, nil for commands without one.
+var commandPayloads = map[string]interface{}{
+	CMD_PING:           nil,
+	CMD_STATUS:         SessionPayload{},
+	CMD_DRAW_NUMBER:    SessionPayload{},
+	CMD_ADD_PLAYER:     AddPlayerPayload{},
+	CMD_RESUME:         ResumePayload{},
+	CMD_SPECTATE:       SessionPayload{},
+	CMD_CHAT:           ChatPayload{},
+	CMD_MUTE:           MutePayload{},
+	CMD_DELETE_MESSAGE: DeleteMessagePayload{},
+	CMD_SLOW_MODE:      SlowModePayload{},
+	CMD_INVITE:         InvitePayload{},
+	CMD_VERIFY:         VerifyPayload{},
+	CMD_END_SESSION:    SessionPayload{},
+	CMD_ADD_WEBHOOK:    AddWebhookPayload{},
+	CMD_REMOVE_WEBHOOK: RemoveWebhookPayload{},
+}
+
+// Description of an HTTP route for the OpenAPI document, the method and
+// path come from the route of the same name.
+type APIOperation struct {
+	Summary  string
+	Request  interface{}
+	Response interface{}
+	Status   int
+	// Needs the host token or an invite as bearer token.
+	Auth bool
+	// Media types of the response by the value of the format query
+	// parameter, the response is JSON when there are none.
+	Formats map[string]string
+}
+
+var apiOperations = map[string]APIOperation{
+	"Status":                {Summary: "Check the server is up", Response: StatusResp{}, Status: http.StatusOK},
+	"Ticket":                {Summary: "Get a websocket handshake ticket", Response: TicketResp{}, Status: http.StatusOK},
+	"Metrics":               {Summary: "Server metrics", Response: MetricsResp{}, Status: http.StatusOK},
+	"SessionCommands":       {Summary: "Send a command for an event stream", Request: Command{}, Response: StatusResp{}, Status: http.StatusAccepted},
+	"ListSessions":          {Summary: "List the sessions of this instance the bearer token is a host of", Response: SessionList{}, Status: http.StatusOK, Auth: true},
+	"CreateSession":         {Summary: "Create a session owned by the caller", Request: CreateSessionReq{}, Response: SessionCreated{}, Status: http.StatusCreated},
+	"GetSession":            {Summary: "Get the snapshot of a session", Response: SessionSnapshot{}, Status: http.StatusOK, Auth: true},
+	"EndSession":            {Summary: "End a session without a winner", Response: StatusResp{}, Status: http.StatusOK, Auth: true},
+	"ListPlayers":           {Summary: "List the players of a session with their cards", Response: PlayerList{}, Status: http.StatusOK, Auth: true},
+	"ListDraws":             {Summary: "List the numbers drawn in a session", Response: DrawList{}, Status: http.StatusOK, Auth: true},
+	"Draw":                  {Summary: "Draw the next number of a session", Response: DrawResp{}, Status: http.StatusCreated, Auth: true},
+	"AddWebhook":            {Summary: "Subscribe a webhook to the events of a session", Request: AddWebhookPayload{}, Response: WebhookAdded{}, Status: http.StatusCreated, Auth: true},
+	"RemoveWebhook":         {Summary: "Drop a webhook of a session", Response: StatusResp{}, Status: http.StatusOK, Auth: true},
+	"ListHistory":           {Summary: "List the finished games the bearer token was the owner of, narrowed down by session_id and player", Response: HistoryList{}, Status: http.StatusOK, Auth: true},
+	"GetHistory":            {Summary: "Get the results of a finished game", Response: GameReport{}, Status: http.StatusOK, Auth: true},
+	"ExportHistory":         {Summary: "Export the results of a finished game as json, csv or html", Response: GameReport{}, Status: http.StatusOK, Auth: true, Formats: map[string]string{EXPORT_JSON: "application/json", EXPORT_CSV: "text/csv", EXPORT_HTML: "text/html"}},
+	"WebhookTestDeliveries": {Summary: "Deliveries received by the webhook stand-in, in test mode", Response: WebhookReceipts{}, Status: http.StatusOK},
+}
+
+// Builds schemas of Go types, named structs go to defs and are
+// referenced with prefix.
+type schemaBuilder struct {
+	prefix string
+	defs   map[string]interface{}
+}
+
+type schema map[string]interface{}
+
+var pathParam = regexp.MustCompile(`{([^}]+)}`)
+var timeType = reflect.TypeOf(time.Time{})
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+var apiDocs map[string][]byte
+var apiDocsOnce sync.Once
+
+// The routes, set by init as the route table refers to the handlers
+// serving the documents.
+var documentedRoutes Routes
+
+func (sb *schemaBuilder) of(t reflect.Type) schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": "array", "items": sb.of(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": sb.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.object(t)
+		}
+		if _, ok := sb.defs[t.Name()]; !ok {
+			// Set first so recursive types end.
+			sb.defs[t.Name()] = schema{}
+			sb.defs[t.Name()] = sb.object(t)
+		}
+		return schema{"$ref": sb.prefix + t.Name()}
+	}
+	// interface{} holds anything.
+	return schema{}
+}
+
+// object builds the schema of a struct from its json tags, fields
+// without omitempty are required.
+func (sb *schemaBuilder) object(t reflect.Type) schema {
+	properties := schema{}
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = sb.of(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	s := schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// withConst pins a string property of the schema to one value.
+func withConst(s schema, property string, value string) schema {
+	return schema{"allOf": []interface{}{s,
+		schema{"properties": schema{property: schema{"const": value}}}}}
+}
+
+// websocketSchemas describes every message sent over websockets and
+// event streams, and every command with its payload.
+func websocketSchemas() schema {
+	sb := &schemaBuilder{prefix: "#/$defs/", defs: make(map[string]interface{})}
+	messages := schema{}
+	for msgType, v := range serverMessages {
+		messages[msgType] = withConst(sb.of(reflect.TypeOf(v)), "msg_type", msgType)
+	}
+	envelope := sb.of(reflect.TypeOf(Command{}))
+	commands := schema{}
+	for cmdType, v := range commandPayloads {
+		payload := schema{}
+		if v != nil {
+			payload = sb.of(reflect.TypeOf(v))
+		}
+		commands[cmdType] = schema{"allOf": []interface{}{envelope,
+			schema{"properties": schema{"type": schema{"const": cmdType},
+				"v":       schema{"const": PROTOCOL_VERSION},
+				"payload": payload}}}}
+	}
+	return schema{"$schema": SCHEMA_DIALECT,
+		"title":           "Bingo websocket messages",
+		"server_messages": messages,
+		"commands":        commands,
+		"$defs":           sb.defs}
+}
+
+// openAPI describes the HTTP routes that have an APIOperation.
+func openAPI() schema {
+	sb := &schemaBuilder{prefix: "#/components/schemas/", defs: make(map[string]interface{})}
+	errorResp := schema{"description": "error",
+		"content": schema{"application/json": schema{"schema": sb.of(reflect.TypeOf(APIError{}))}}}
+	paths := schema{}
+	for _, route := range documentedRoutes {
+		op, ok := apiOperations[route.Name]
+		if !ok {
+			continue
+		}
+		content := schema{"application/json": schema{"schema": sb.of(reflect.TypeOf(op.Response))}}
+		operation := schema{"operationId": route.Name,
+			"summary": op.Summary,
+			"responses": schema{fmt.Sprint(op.Status): schema{"description": http.StatusText(op.Status),
+				"content": content},
+				"default": errorResp}}
+		params := make([]interface{}, 0)
+		for _, m := range pathParam.FindAllStringSubmatch(route.Pattern, -1) {
+			params = append(params, schema{"name": m[1], "in": "path", "required": true, "schema": schema{"type": "string"}})
+		}
+		if len(op.Formats) > 0 {
+			formats := make([]string, 0, len(op.Formats))
+			for format, mediaType := range op.Formats {
+				formats = append(formats, format)
+				if mediaType != "application/json" {
+					content[mediaType] = schema{"schema": schema{"type": "string"}}
+				}
+			}
+			sort.Strings(formats)
+			params = append(params, schema{"name": "format", "in": "query", "schema": schema{"type": "string", "enum": formats}})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = schema{"required": true,
+				"content": schema{"application/json": schema{"schema": sb.of(reflect.TypeOf(op.Request))}}}
+		}
+		if op.Auth {
+			operation["security"] = []interface{}{schema{"hostToken": []string{}}}
+		}
+		if paths[route.Pattern] == nil {
+			paths[route.Pattern] = schema{}
+		}
+		paths[route.Pattern].(schema)[strings.ToLower(route.Method)] = operation
+	}
+	webhooks := schema{}
+	for _, event := range webhookEvents {
+		webhooks[event] = schema{"post": schema{"operationId": "webhook_" + event,
+			"summary": "Delivery of " + event + ", signed in the " + WEBHOOK_SIGNATURE_HEADER + " header",
+			"requestBody": schema{"required": true,
+				"content": schema{"application/json": schema{"schema": withConst(sb.of(reflect.TypeOf(WebhookEvent{})), "event", event)}}},
+			"responses": schema{"2XX": schema{"description": "Delivered, other statuses are retried"}}}}
+	}
+	return schema{"openapi": OPENAPI_VERSION,
+		"info": schema{"title": "Bingo", "version": fmt.Sprint(PROTOCOL_VERSION),
+			"description": "Websocket messages are described at /schemas/websocket.json."},
+		"jsonSchemaDialect": SCHEMA_DIALECT,
+		"paths":             paths,
+		"webhooks":          webhooks,
+		"components": schema{"schemas": sb.defs,
+			"securitySchemes": schema{"hostToken": schema{"type": "http", "scheme": "bearer",
+				"description": "Host token of the session owner or a co-host invite"}}}}
+}
+
+func serveAPIDoc(w http.ResponseWriter, r *http.Request, name string) {
+	fmt.Println("API: ", r.URL.Path)
+	apiDocsOnce.Do(func() {
+		apiDocs = make(map[string][]byte)
+		for docName, doc := range map[string]schema{"openapi": openAPI(), "websocket": websocketSchemas()} {
+			data, err := json.MarshalIndent(doc, "", "  ")
+			if err != nil {
+				panic(err)
+			}
+			apiDocs[docName] = data
+		}
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(apiDocs[name])
+}
+
+func OpenAPIDoc(w http.ResponseWriter, r *http.Request) {
+	serveAPIDoc(w, r, "openapi")
+}
+
+func WebsocketSchemas(w http.ResponseWriter, r *http.Request) {
+	serveAPIDoc(w, r, "websocket")
+}
+
+func init() {
+	documentedRoutes = routes
+}
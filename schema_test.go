@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSchemas(t *testing.T) {
+	messages := websocketSchemas()["server_messages"].(schema)
+	for _, msgType := range []string{"server_shutdown", "session_ended", REPLY_ERROR} {
+		if messages[msgType] == nil {
+			t.Error("no schema for", msgType)
+		}
+	}
+
+	data, err := json.Marshal(openAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			OperationId string `json:"operationId"`
+			Parameters  []struct {
+				Name   string `json:"name"`
+				In     string `json:"in"`
+				Schema struct {
+					Enum []string `json:"enum"`
+				} `json:"schema"`
+			} `json:"parameters"`
+			Responses map[string]struct {
+				Content map[string]interface{} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, methods := range doc.Paths {
+		op, ok := methods["get"]
+		if !ok || op.OperationId != "ExportHistory" {
+			continue
+		}
+		found = true
+		content := op.Responses["200"].Content
+		for _, mediaType := range []string{"application/json", "text/csv", "text/html"} {
+			if content[mediaType] == nil {
+				t.Error("ExportHistory doesn't document", mediaType)
+			}
+		}
+		formats := ""
+		for _, param := range op.Parameters {
+			if param.Name == "format" && param.In == "query" {
+				formats = strings.Join(param.Schema.Enum, ",")
+			}
+		}
+		if formats != "csv,html,json" {
+			t.Error("ExportHistory formats:", formats)
+		}
+	}
+	if !found {
+		t.Fatal("ExportHistory isn't documented")
+	}
+}
@@ -0,0 +1,125 @@
+/*
+*
+* Graceful shutdown.
+* On SIGINT or SIGTERM the server stops accepting upgrades, tells every
+* admin and player it is going away, gives up the leases of the active
+* games and closes the websockets before the shutdown deadline. What is
+* left to save of the games then goes to the session store, which is
+* closed.
+*
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Set once the server is shutting down.
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+// serve runs the server until it is signalled to stop.
+func serve(router http.Handler) error {
+	srv := &http.Server{Addr: serverConfig.ListenAddr, Handler: router}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		log.Println("Received", sig, "shutting down..")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+	defer cancel()
+	return shutdown(ctx, srv)
+}
+
+func shutdown(ctx context.Context, srv *http.Server) error {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	liveClientsLock.Lock()
+	for c := range liveClients {
+		c.SendJSON(WebMsgOut{Msg_Type: "server_shutdown"})
+		c.Close(websocket.CloseGoingAway, "server shutting down")
+	}
+	liveClientsLock.Unlock()
+
+	// Other instances may take the sessions over right away.
+	gamesLock.Lock()
+	sessionIds := make([]string, 0, len(games.activeSessions))
+	for sessionId := range games.activeSessions {
+		sessionIds = append(sessionIds, sessionId)
+	}
+	gamesLock.Unlock()
+	for _, sessionId := range sessionIds {
+		if err := broker.Release(sessionKey(sessionId), instanceId); err != nil {
+			log.Println(err)
+		}
+	}
+
+	// Stops the listener once the event streams have ended, hijacked
+	// websockets are left to us.
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println(err)
+	}
+
+	err := waitForClients(ctx)
+	saveActiveGames()
+	if closeErr := sessionStore.Close(); closeErr != nil {
+		log.Println("couldn't close the session store:", closeErr)
+	}
+	return err
+}
+
+// waitForClients returns once every connection is closed, or with an
+// error when ctx is done first.
+func waitForClients(ctx context.Context) error {
+	for {
+		if metrics := collectMetrics(); metrics.Clients == 0 {
+			log.Println("All connections closed.")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("shutdown deadline passed with open connections")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// saveActiveGames writes the changes of the active games not saved yet
+// to the session store, their players resume from it on restart.
+func saveActiveGames() {
+	gamesLock.Lock()
+	hubs := make([]*SessionHub, 0, len(games.activeSessions))
+	for _, b := range games.activeSessions {
+		hubs = append(hubs, b.hub)
+	}
+	gamesLock.Unlock()
+
+	log.Println("Saving", len(hubs), "active games")
+	for _, hub := range hubs {
+		hub.call(func() {
+			hub.persist()
+			hub.stopSaver()
+		})
+	}
+}
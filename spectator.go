@@ -0,0 +1,165 @@
+/*
+*
+* Spectators.
+* A spectator follows a session read-only, e.g. on the big screen at an
+* event. It never gets player cards, only the caller board: every ball
+* with its called state, the last calls, the pattern being played, the
+* player counts and the winners. Spectators are not players of the game,
+* the admins only see how many are watching.
+*
+ */
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+)
+
+//
+// Caller board layout.
+//
+const (
+	BOARD_BALLS      = 75
+	BOARD_LAST_CALLS = 5
+	BOARD_LETTERS    = "BINGO"
+)
+
+//
+// Winning patterns.
+//
+const (
+	PATTERN_FULL_HOUSE = "full_house"
+)
+
+type BoardBall struct {
+	Number int    `json:"number"`
+	Letter string `json:"letter"`
+	Called bool   `json:"called"`
+}
+
+// Board sent to spectators whenever the game changes.
+type CallerBoard struct {
+	Msg_Type          string      `json:"msg_type"`
+	Session_Id        string      `json:"session_id"`
+	Balls             []BoardBall `json:"balls"`
+	Last_Calls        []int       `json:"last_calls"`
+	Pattern           string      `json:"pattern"`
+	Players           int         `json:"players"`
+	Connected_Players int         `json:"connected_players"`
+	Winners           []string    `json:"winners"`
+	Game_State        string      `json:"game_state"`
+}
+
+// Number of spectators, sent to the admins when it changes.
+type SpectatorCount struct {
+	Msg_Type   string `json:"msg_type"`
+	Spectators int    `json:"spectators"`
+}
+
+// pattern returns the pattern a card has to complete to win.
+func (b *BingoGame) pattern() string {
+	return PATTERN_FULL_HOUSE
+}
+
+// board builds the caller board of the game, newest call first.
+func (b *BingoGame) board() CallerBoard {
+	draws := b.drawnNumbers()
+	board := CallerBoard{Msg_Type: "board",
+		Session_Id: b.GameId,
+		Balls:      make([]BoardBall, BOARD_BALLS),
+		Last_Calls: make([]int, 0),
+		Pattern:    b.pattern(),
+		Players:    len(b.GamePlayers),
+		Winners:    append([]string{}, b.winners...),
+		Game_State: b.state()}
+	called := make(map[int]bool)
+	for _, d := range draws {
+		called[d] = true
+	}
+	for i := range board.Balls {
+		n := i + 1
+		board.Balls[i] = BoardBall{Number: n,
+			Letter: string(BOARD_LETTERS[i/(BOARD_BALLS/len(BOARD_LETTERS))]),
+			Called: called[n]}
+	}
+	for i := len(draws) - 1; i >= 0 && len(board.Last_Calls) < BOARD_LAST_CALLS; i-- {
+		board.Last_Calls = append(board.Last_Calls, draws[i])
+	}
+	for _, playerSheet := range b.GamePlayers {
+		if playerSheet.Connected {
+			board.Connected_Players++
+		}
+	}
+	return board
+}
+
+// spectate adds c to the spectators of the session.
+func (h *SessionHub) spectate(c *Client, cmd *Command) {
+	h.spectators[c] = true
+	sendReply(c, NewAckReply(cmd, map[string]interface{}{"session_id": h.game.GameId}))
+	c.SendJSON(h.game.board())
+	log.Println("Admin: spectator joined:", h.game.GameId, c.addr)
+	h.countSpectators()
+}
+
+// updateBoard sends the current board to every spectator.
+func (h *SessionHub) updateBoard() {
+	if len(h.spectators) == 0 {
+		return
+	}
+	out, err := NewBroadcast(h.game.board())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for c := range h.spectators {
+		c.SendOutbound(out)
+	}
+}
+
+func (h *SessionHub) countSpectators() {
+	out, err := NewBroadcast(SpectatorCount{Msg_Type: "spectators", Spectators: len(h.spectators)})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for c := range h.admins {
+		c.SendOutbound(out)
+	}
+}
+
+func Spectate(w http.ResponseWriter, r *http.Request) {
+	client, err := upgradeClient(w, r, ROLE_SPECTATOR)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println("Spectator websocket upgraded for remote client:", client.addr)
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// closeSpectators disconnects the spectators once the final board is
+// written.
+func (h *SessionHub) closeSpectators() {
+	for c := range h.spectators {
+		c.Close(websocket.CloseNormalClosure, ERR_GAME_OVER)
+	}
+}
+
+func Board(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	sessionId := mux.Vars(r)["sessId"]
+	if !sessionActive(sessionId) {
+		fmt.Println("No active session:", sessionId)
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	body, _ := readFile("board")
+	w.Write(body)
+}
@@ -0,0 +1,250 @@
+/*
+*
+* Server-Sent Events transport.
+* For networks that block websockets a client can follow a session on
+* /sessions/{sessId}/events and send its commands to
+* /sessions/{sessId}/commands, naming the stream they belong to. Events
+* carry their sequence number as SSE id, so a reconnecting stream only
+* gets the events after its Last-Event-ID.
+*
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// First message of every stream, names it for the commands endpoint.
+type StreamOpened struct {
+	Msg_Type  string `json:"msg_type"`
+	Stream_Id string `json:"stream_id"`
+}
+
+// Last message of a stream closed by the server, the client shouldn't
+// reconnect after a normal closure.
+type StreamClosed struct {
+	Msg_Type string `json:"msg_type"`
+	Code     int    `json:"code"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type EventStream struct {
+	client *Client
+	// Serializes the commands posted to the stream, they share the
+	// client's limiter and hub like the read pump of a websocket.
+	mu sync.Mutex
+}
+
+// Open event streams by stream id.
+var eventStreams map[string]*EventStream
+var eventStreamsLock sync.Mutex
+
+func findEventStream(streamId string, sessionId string) *EventStream {
+	eventStreamsLock.Lock()
+	defer eventStreamsLock.Unlock()
+	stream, ok := eventStreams[streamId]
+	if !ok || stream.client.session != sessionId {
+		return nil
+	}
+	return stream
+}
+
+// lastEventId returns the last event a reconnecting stream has seen.
+// Browsers send the Last-Event-ID header, pages opening a new stream
+// pass it as the last_event_id query parameter.
+func lastEventId(r *http.Request) int64 {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("last_event_id")
+	}
+	seq, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || seq < 0 {
+		return 0
+	}
+	return seq
+}
+
+// SessionEvents streams the events of a session. Admin and spectator
+// streams join the session right away, hosts with the host_token query
+// parameter, a player stream once it posts add_player or resume.
+func SessionEvents(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	sessionId := mux.Vars(r)["sessId"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if isShuttingDown() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !originAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role == "" {
+		role = ROLE_PLAYER
+	}
+	if err := RedeemTicket(r.URL.Query().Get("ticket"), role, time.Now()); err != nil {
+		log.Println(r.RemoteAddr, "event stream refused:", err)
+		http.Error(w, "invalid handshake ticket", http.StatusForbidden)
+		return
+	}
+
+	if role != ROLE_ADMIN && !sessionActive(sessionId) {
+		gamesLock.Lock()
+		ended := games.endedSessions[sessionId]
+		gamesLock.Unlock()
+		if ended {
+			http.Error(w, "game is over", http.StatusGone)
+		} else {
+			http.Error(w, "no session found", http.StatusNotFound)
+		}
+		return
+	}
+
+	ip := remoteIP(r)
+	if !acquireConnSlot(ip) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+	c := NewClient(nil, role)
+	c.addr = r.RemoteAddr
+	c.ip = ip
+	c.session = sessionId
+	c.resumeSeq = lastEventId(r)
+
+	streamId := newResumeToken()
+	stream := &EventStream{client: c}
+	eventStreamsLock.Lock()
+	eventStreams[streamId] = stream
+	eventStreamsLock.Unlock()
+	defer func() {
+		eventStreamsLock.Lock()
+		delete(eventStreams, streamId)
+		eventStreamsLock.Unlock()
+
+		stream.mu.Lock()
+		c.leaveSession()
+		stream.mu.Unlock()
+		c.Close(websocket.CloseNormalClosure, "")
+		untrackClient(c)
+		releaseConnSlot(ip)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	log.Println("Event stream opened for", sessionId, "for remote client:", r.RemoteAddr, "role:", role)
+
+	c.SendJSON(StreamOpened{Msg_Type: "stream", Stream_Id: streamId})
+	if role != ROLE_PLAYER {
+		// Joins like any command would, wherever the session is run.
+		join := Command{Version: PROTOCOL_VERSION, Type: CMD_SPECTATE, RequestId: streamId}
+		if role == ROLE_ADMIN {
+			join.Type = CMD_STATUS
+		}
+		join.Payload, _ = json.Marshal(SessionPayload{SessionId: sessionId,
+			LastSeq:   c.resumeSeq,
+			HostToken: r.URL.Query().Get("host_token")})
+		msg, _ := json.Marshal(join)
+		stream.mu.Lock()
+		c.handleMessage(msg)
+		stream.mu.Unlock()
+	}
+	c.streamPump(w, flusher, r.Context().Done())
+}
+
+// streamPump writes the queued messages of an event stream client until
+// it's closed or the request goes away.
+func (c *Client) streamPump(w http.ResponseWriter, flusher http.Flusher, gone <-chan struct{}) {
+	ticker := time.NewTicker(PING_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case out, ok := <-c.send:
+			if !ok || c.isEvicted() {
+				closed, _ := json.Marshal(StreamClosed{Msg_Type: "stream_closed", Code: c.closeCode, Reason: c.closeReason})
+				fmt.Fprintf(w, "data: %s\n\n", closed)
+				flusher.Flush()
+				return
+			}
+			if err := writeEvent(w, out.data); err != nil {
+				log.Println(err)
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			// Comment lines keep proxies from timing out idle streams.
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				log.Println(err)
+				return
+			}
+			flusher.Flush()
+		case <-gone:
+			return
+		}
+	}
+}
+
+// writeEvent writes msg as an SSE event, with its sequence number as id
+// when it is a session event.
+func writeEvent(w http.ResponseWriter, msg []byte) error {
+	var event struct {
+		Seq int64 `json:"seq"`
+	}
+	json.Unmarshal(msg, &event)
+	if event.Seq > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.Seq); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "data: %s\n\n", msg)
+	return err
+}
+
+// SessionCommands takes a command for the event stream named by the
+// "stream" query parameter. Replies are sent on the stream.
+func SessionCommands(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	if !originAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	stream := findEventStream(r.URL.Query().Get("stream"), mux.Vars(r)["sessId"])
+	if stream == nil {
+		http.Error(w, "unknown event stream", http.StatusNotFound)
+		return
+	}
+	msg, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, serverConfig.ReadLimit))
+	if err != nil {
+		http.Error(w, "command too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	stream.mu.Lock()
+	open := stream.client.handleMessage(msg)
+	stream.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(StatusResp{Status: open}); err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	eventStreams = make(map[string]*EventStream)
+}
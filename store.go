@@ -0,0 +1,794 @@
+/*
+*
+* Session store.
+* A hub appends the events of its game to the SessionStore as they are
+* logged, together with the token of the owner, and moves the game to the
+* archive when it is over. The writes run on a saver goroutine of the
+* session, so the hub never waits on the disk. On startup the games left
+* in the store are replayed from their logs and run again, so players
+* resume with the cards they had. The memory store doesn't outlive the
+* process, the json store keeps a directory with a file per session and
+* per archived game, and the bolt store an embedded database.
+*
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Buckets of the bolt store, and time allowed to lock its file.
+//
+const (
+	BOLT_BUCKET         = "sessions"
+	BOLT_EVENTS_BUCKET  = "events"
+	BOLT_ARCHIVE_BUCKET = "archive"
+	BOLT_OPEN_TIMEOUT   = time.Second
+)
+
+//
+// Layout of the json store directory.
+//
+const (
+	JSON_SESSION_EXT = ".jsonl"
+	JSON_ARCHIVE_DIR = "archive"
+	JSON_ARCHIVE_EXT = ".json"
+)
+
+// Time a saver waits before writing again after a failed write.
+const STORE_RETRY = time.Second
+
+// A session as saved to the store.
+type StoredSession struct {
+	SessionId  string `json:"session_id"`
+	OwnerToken string `json:"owner_token,omitempty"`
+	// Last event sent to the clients of the session.
+	Seq    int64       `json:"seq"`
+	Events []GameEvent `json:"events"`
+	// Webhooks the owner subscribed to the session.
+	Webhooks []StoredWebhook `json:"webhooks,omitempty"`
+}
+
+// A session webhook as saved with its session.
+type StoredWebhook struct {
+	Id     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+type SessionStore interface {
+	// Append adds the events of session to the end of its stored log, and
+	// sets its owner token, seq and webhooks. The session is stored with
+	// its first events.
+	Append(session *StoredSession) error
+	Delete(sessionId string) error
+	// Load returns every stored session.
+	Load() ([]*StoredSession, error)
+	// Session returns a stored session, nil when there is none.
+	Session(sessionId string) (*StoredSession, error)
+	// Archive keeps a finished game for the history.
+	Archive(game *ArchivedGame) error
+	// History returns every archived game.
+	History() ([]*ArchivedGame, error)
+	// Archived returns an archived game, nil when there is none.
+	Archived(archiveId string) (*ArchivedGame, error)
+	Close() error
+}
+
+// NewSessionStore opens the store at addr, "memory", json:dir or
+// bolt:path.
+func NewSessionStore(addr string) (SessionStore, error) {
+	if addr == "" || addr == "memory" {
+		return NewMemoryStore(), nil
+	}
+	kind, path := addr, ""
+	if i := strings.Index(addr, ":"); i >= 0 {
+		kind, path = addr[:i], addr[i+1:]
+	}
+	if path == "" {
+		return nil, fmt.Errorf("session store needs a path: %s", addr)
+	}
+	switch kind {
+	case "json":
+		return OpenJSONStore(path)
+	case "bolt":
+		return OpenBoltStore(path)
+	}
+	return nil, fmt.Errorf("unsupported session store: %s", addr)
+}
+
+type MemoryStore struct {
+	mu       sync.Mutex
+	sessions map[string]*StoredSession
+	archive  map[string]*ArchivedGame
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]*StoredSession),
+		archive: make(map[string]*ArchivedGame)}
+}
+
+func (s *MemoryStore) Append(session *StoredSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved, ok := s.sessions[session.SessionId]
+	if !ok {
+		saved = &StoredSession{SessionId: session.SessionId}
+		s.sessions[session.SessionId] = saved
+	}
+	saved.OwnerToken = session.OwnerToken
+	saved.Seq = session.Seq
+	saved.Events = append(saved.Events, session.Events...)
+	saved.Webhooks = append([]StoredWebhook(nil), session.Webhooks...)
+	return nil
+}
+
+func (s *MemoryStore) Delete(sessionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionId)
+	return nil
+}
+
+func (s *MemoryStore) Load() ([]*StoredSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*StoredSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session.copy())
+	}
+	return sessions, nil
+}
+
+func (s *MemoryStore) Session(sessionId string) (*StoredSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[sessionId]; ok {
+		return session.copy(), nil
+	}
+	return nil, nil
+}
+
+func (session *StoredSession) copy() *StoredSession {
+	loaded := *session
+	loaded.Events = append([]GameEvent{}, session.Events...)
+	loaded.Webhooks = append([]StoredWebhook(nil), session.Webhooks...)
+	return &loaded
+}
+
+func (s *MemoryStore) Archive(game *ArchivedGame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	archived := *game
+	archived.Events = append([]GameEvent{}, game.Events...)
+	s.archive[game.ArchiveId] = &archived
+	return nil
+}
+
+func (s *MemoryStore) History() ([]*ArchivedGame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := make([]*ArchivedGame, 0, len(s.archive))
+	for _, game := range s.archive {
+		history = append(history, game)
+	}
+	return history, nil
+}
+
+func (s *MemoryStore) Archived(archiveId string) (*ArchivedGame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.archive[archiveId], nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Keeps each session in a file of its own in dir, a JSON line for every
+// append, and each archived game in a file under dir/archive. Saving a
+// session only appends to its file.
+type JSONStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func OpenJSONStore(dir string) (*JSONStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, JSON_ARCHIVE_DIR), 0700); err != nil {
+		return nil, err
+	}
+	return &JSONStore{dir: dir}, nil
+}
+
+// jsonStoreName returns a file name for id, which may hold any character.
+func jsonStoreName(id string, ext string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + ext
+}
+
+func (s *JSONStore) Append(session *StoredSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.dir, jsonStoreName(session.SessionId, JSON_SESSION_EXT))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *JSONStore) Delete(sessionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := os.Remove(filepath.Join(s.dir, jsonStoreName(sessionId, JSON_SESSION_EXT)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *JSONStore) Load() ([]*StoredSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+JSON_SESSION_EXT))
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*StoredSession, 0, len(paths))
+	for _, path := range paths {
+		session, err := loadJSONSession(path)
+		if err != nil {
+			return nil, err
+		}
+		if session != nil {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *JSONStore) Session(sessionId string) (*StoredSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, err := loadJSONSession(filepath.Join(s.dir, jsonStoreName(sessionId, JSON_SESSION_EXT)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return session, err
+}
+
+// loadJSONSession joins the appends of a session file. A line that
+// doesn't parse was cut short by a crash and is skipped, and so are
+// events written again after a failed append.
+func loadJSONSession(path string) (*StoredSession, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var session *StoredSession
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var appended StoredSession
+			if jsonErr := json.Unmarshal(line, &appended); jsonErr != nil {
+				log.Println("skipping a broken line of", path, jsonErr)
+			} else {
+				if session == nil {
+					session = &StoredSession{SessionId: appended.SessionId}
+				}
+				session.OwnerToken = appended.OwnerToken
+				session.Seq = appended.Seq
+				session.Webhooks = appended.Webhooks
+				for _, ev := range appended.Events {
+					if n := len(session.Events); n == 0 || ev.Seq > session.Events[n-1].Seq {
+						session.Events = append(session.Events, ev)
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			return session, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *JSONStore) Archive(game *ArchivedGame) error {
+	data, err := json.Marshal(game)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeFile(filepath.Join(s.dir, JSON_ARCHIVE_DIR, jsonStoreName(game.ArchiveId, JSON_ARCHIVE_EXT)), data)
+}
+
+func (s *JSONStore) History() ([]*ArchivedGame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(s.dir, JSON_ARCHIVE_DIR, "*"+JSON_ARCHIVE_EXT))
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*ArchivedGame, 0, len(paths))
+	for _, path := range paths {
+		game, err := readArchivedGame(path)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, game)
+	}
+	return history, nil
+}
+
+func (s *JSONStore) Archived(archiveId string) (*ArchivedGame, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	game, err := readArchivedGame(filepath.Join(s.dir, JSON_ARCHIVE_DIR, jsonStoreName(archiveId, JSON_ARCHIVE_EXT)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return game, err
+}
+
+func (s *JSONStore) Close() error {
+	return nil
+}
+
+func readArchivedGame(path string) (*ArchivedGame, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var game ArchivedGame
+	if err := json.Unmarshal(data, &game); err != nil {
+		return nil, fmt.Errorf("malformed archived game %s: %v", path, err)
+	}
+	return &game, nil
+}
+
+// writeFile replaces the file at path, through a temporary one so a crash
+// never leaves half of it.
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Keeps each session in a bucket of its own in an embedded bolt database,
+// its owner token, seq and an events bucket keyed by the seq of each
+// event, and each archived game under its id.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{BOLT_BUCKET, BOLT_ARCHIVE_BUCKET} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// boltSeq returns the key of the event at seq, ordered as the events are.
+func boltSeq(seq int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(seq))
+	return key
+}
+
+func (s *BoltStore) Append(session *StoredSession) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(BOLT_BUCKET)).CreateBucketIfNotExists([]byte(session.SessionId))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("owner_token"), []byte(session.OwnerToken)); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("seq"), []byte(strconv.FormatInt(session.Seq, 10))); err != nil {
+			return err
+		}
+		webhooks, err := json.Marshal(session.Webhooks)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("webhooks"), webhooks); err != nil {
+			return err
+		}
+		events, err := b.CreateBucketIfNotExists([]byte(BOLT_EVENTS_BUCKET))
+		if err != nil {
+			return err
+		}
+		for _, ev := range session.Events {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			if err := events.Put(boltSeq(ev.Seq), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Delete(sessionId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket([]byte(BOLT_BUCKET))
+		if sessions.Bucket([]byte(sessionId)) == nil {
+			return nil
+		}
+		return sessions.DeleteBucket([]byte(sessionId))
+	})
+}
+
+func (s *BoltStore) Load() ([]*StoredSession, error) {
+	sessions := make([]*StoredSession, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		all := tx.Bucket([]byte(BOLT_BUCKET))
+		return all.ForEach(func(k, v []byte) error {
+			b := all.Bucket(k)
+			if b == nil {
+				return nil
+			}
+			session, err := loadBoltSession(string(k), b)
+			if err != nil {
+				return err
+			}
+			sessions = append(sessions, session)
+			return nil
+		})
+	})
+	return sessions, err
+}
+
+func (s *BoltStore) Session(sessionId string) (*StoredSession, error) {
+	var session *StoredSession
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BOLT_BUCKET)).Bucket([]byte(sessionId))
+		if b == nil {
+			return nil
+		}
+		var err error
+		session, err = loadBoltSession(sessionId, b)
+		return err
+	})
+	return session, err
+}
+
+func loadBoltSession(sessionId string, b *bolt.Bucket) (*StoredSession, error) {
+	session := &StoredSession{SessionId: sessionId, OwnerToken: string(b.Get([]byte("owner_token")))}
+	seq, err := strconv.ParseInt(string(b.Get([]byte("seq"))), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed stored session %s: %v", sessionId, err)
+	}
+	session.Seq = seq
+	if webhooks := b.Get([]byte("webhooks")); webhooks != nil {
+		if err := json.Unmarshal(webhooks, &session.Webhooks); err != nil {
+			return nil, fmt.Errorf("malformed stored session %s: %v", sessionId, err)
+		}
+	}
+	if events := b.Bucket([]byte(BOLT_EVENTS_BUCKET)); events != nil {
+		err = events.ForEach(func(_, data []byte) error {
+			var ev GameEvent
+			if err := json.Unmarshal(data, &ev); err != nil {
+				return fmt.Errorf("malformed stored session %s: %v", sessionId, err)
+			}
+			session.Events = append(session.Events, ev)
+			return nil
+		})
+	}
+	return session, err
+}
+
+func (s *BoltStore) Archive(game *ArchivedGame) error {
+	data, err := json.Marshal(game)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BOLT_ARCHIVE_BUCKET)).Put([]byte(game.ArchiveId), data)
+	})
+}
+
+func (s *BoltStore) History() ([]*ArchivedGame, error) {
+	history := make([]*ArchivedGame, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BOLT_ARCHIVE_BUCKET)).ForEach(func(k, v []byte) error {
+			var game ArchivedGame
+			if err := json.Unmarshal(v, &game); err != nil {
+				return fmt.Errorf("malformed archived game %s: %v", k, err)
+			}
+			history = append(history, &game)
+			return nil
+		})
+	})
+	return history, err
+}
+
+func (s *BoltStore) Archived(archiveId string) (*ArchivedGame, error) {
+	var game *ArchivedGame
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(BOLT_ARCHIVE_BUCKET)).Get([]byte(archiveId))
+		if data == nil {
+			return nil
+		}
+		game = &ArchivedGame{}
+		if err := json.Unmarshal(data, game); err != nil {
+			return fmt.Errorf("malformed archived game %s: %v", archiveId, err)
+		}
+		return nil
+	})
+	return game, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+var sessionStore SessionStore = NewMemoryStore()
+
+// startStore opens the session store and runs the games left in it.
+func startStore(cfg ServerConfig) error {
+	store, err := NewSessionStore(cfg.Store)
+	if err != nil {
+		return err
+	}
+	sessionStore = store
+	return restoreSessions()
+}
+
+// restoreSessions replays the stored games and runs the ones no other
+// instance has taken over. Their players are disconnected until they
+// resume.
+func restoreSessions() error {
+	stored, err := sessionStore.Load()
+	if err != nil {
+		return err
+	}
+	for _, session := range stored {
+		hub, err := restoredHub(session)
+		if err != nil {
+			log.Println("couldn't restore session", session.SessionId, err)
+			continue
+		}
+		if hub == nil {
+			continue
+		}
+		bGame := hub.game
+		owner, err := broker.Claim(sessionKey(bGame.GameId), instanceId, SESSION_LEASE)
+		if err != nil {
+			return err
+		}
+		if owner != instanceId {
+			log.Println("Stored session", bGame.GameId, "is run by", owner)
+			continue
+		}
+
+		gamesLock.Lock()
+		if _, ok := games.activeSessions[bGame.GameId]; !ok {
+			startSessionHub(hub)
+			log.Println("Session restored:", bGame.GameId, "players:", len(bGame.GamePlayers), "draws:", bGame.drawCount)
+		}
+		gamesLock.Unlock()
+	}
+	return nil
+}
+
+// restoredHub replays a stored session into a hub that isn't started
+// yet, nil when the game had ended. It's archived then.
+func restoredHub(session *StoredSession) (*SessionHub, error) {
+	bGame, err := ReplayGame(session.Events)
+	if err != nil {
+		return nil, err
+	}
+	if bGame.ended {
+		// Ended before it could be archived.
+		archiveGame(bGame, session.OwnerToken)
+		return nil, nil
+	}
+	hub := NewSessionHub(bGame)
+	hub.events.lastSeq = session.Seq
+	hub.ownerToken = session.OwnerToken
+	if hub.ownerToken != "" {
+		hub.ownerGone = time.Now()
+	}
+	for name, playerSheet := range bGame.GamePlayers {
+		hub.setPresence(name, playerSheet, PRESENCE_DISCONNECTED, "")
+	}
+	for _, stored := range session.Webhooks {
+		hub.webhooks = append(hub.webhooks, restoredWebhook(stored))
+	}
+	hub.queued = len(bGame.gameLog)
+	hub.queuedOwner = hub.ownerToken
+	return hub, nil
+}
+
+// persist queues the events logged since the last call to be appended
+// to the stored session, and any change of its owner. Nothing is saved
+// once the hub stopped.
+func (h *SessionHub) persist() {
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+	if h.game.ended || (len(h.game.gameLog) == h.queued && h.ownerToken == h.queuedOwner && !h.webhooksChanged) {
+		return
+	}
+	if h.saver == nil {
+		h.saver = newSessionSaver(sessionStore, h.game.GameId)
+	}
+	h.saver.queue(&StoredSession{OwnerToken: h.ownerToken,
+		Seq:      h.events.LastSeq(),
+		Events:   h.game.gameLog[h.queued:],
+		Webhooks: h.storedWebhooks()})
+	h.queued = len(h.game.gameLog)
+	h.queuedOwner = h.ownerToken
+	h.webhooksChanged = false
+}
+
+// stopSaver writes what is left to save and stops the saver.
+func (h *SessionHub) stopSaver() {
+	if h.saver != nil {
+		h.saver.stop()
+		h.saver = nil
+	}
+}
+
+// Appends the changes of a session to the store on its own goroutine.
+// Changes queued while a write runs, or after it failed, are written
+// together with the next one.
+type sessionSaver struct {
+	store     SessionStore
+	sessionId string
+	mu        sync.Mutex
+	pending   *StoredSession
+	wake      chan struct{}
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+func newSessionSaver(store SessionStore, sessionId string) *sessionSaver {
+	s := &sessionSaver{store: store,
+		sessionId: sessionId,
+		wake:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{})}
+	go s.run()
+	return s
+}
+
+// queue adds the events of update to the pending changes, the events
+// themselves are never changed once logged.
+func (s *sessionSaver) queue(update *StoredSession) {
+	s.mu.Lock()
+	if s.pending == nil {
+		s.pending = &StoredSession{SessionId: s.sessionId}
+	}
+	s.pending.OwnerToken = update.OwnerToken
+	s.pending.Seq = update.Seq
+	s.pending.Events = append(s.pending.Events, update.Events...)
+	s.pending.Webhooks = update.Webhooks
+	s.mu.Unlock()
+	s.signal()
+}
+
+// signal wakes the saver, unless it is awake already.
+func (s *sessionSaver) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sessionSaver) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.wake:
+		case <-s.quit:
+			s.flush()
+			return
+		}
+		if !s.flush() {
+			select {
+			case <-time.After(STORE_RETRY):
+				s.signal()
+			case <-s.quit:
+				s.flush()
+				return
+			}
+		}
+	}
+}
+
+// flush writes the pending changes, which stay pending when the write
+// fails.
+func (s *sessionSaver) flush() bool {
+	s.mu.Lock()
+	update := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if update == nil {
+		return true
+	}
+	if err := s.store.Append(update); err != nil {
+		log.Println("couldn't save session", s.sessionId, err)
+		s.mu.Lock()
+		if s.pending != nil {
+			update.OwnerToken = s.pending.OwnerToken
+			update.Seq = s.pending.Seq
+			update.Events = append(update.Events, s.pending.Events...)
+			update.Webhooks = s.pending.Webhooks
+		}
+		s.pending = update
+		s.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// stop waits for the pending changes to be written and stops the saver.
+func (s *sessionSaver) stop() {
+	close(s.quit)
+	<-s.done
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSessionStoreAppend(t *testing.T) {
+	b, _ := NewBingoGame("stored")
+	b.joinPlayer("ann", "t1")
+	b.dealCard("ann", card(1, 2, 3))
+	b.drawNumber(1)
+	b.drawNumber(2)
+	events := b.GameLog()
+
+	dir := t.TempDir()
+	for _, addr := range []string{"memory", "json:" + filepath.Join(dir, "json"), "bolt:" + filepath.Join(dir, "s.db")} {
+		t.Run(addr[:4], func(t *testing.T) {
+			store, err := NewSessionStore(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			hooks := []StoredWebhook{{Id: "h1", URL: "https://example.com/a", Events: []string{}, Secret: "s1"},
+				{Id: "h2", URL: "https://example.com/b", Events: []string{WEBHOOK_DRAW}, Secret: "s2"}}
+			appends := []*StoredSession{
+				{SessionId: "stored", Seq: 1, Events: events[:2]},
+				{SessionId: "stored", OwnerToken: "owner", Seq: 2, Events: events[2:4], Webhooks: hooks},
+				{SessionId: "stored", OwnerToken: "owner", Seq: 3, Events: events[4:], Webhooks: hooks[1:]},
+				{SessionId: "other", Seq: 1, Events: events[:1]},
+			}
+			for _, session := range appends {
+				if err := store.Append(session); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Delete("other"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete("missing"); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := store.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &StoredSession{SessionId: "stored", OwnerToken: "owner", Seq: 3, Events: events, Webhooks: hooks[1:]}
+			if len(loaded) != 1 || !reflect.DeepEqual(loaded[0], want) {
+				t.Fatalf("loaded %+v, want %+v", loaded, want)
+			}
+			if session, err := store.Session("stored"); err != nil || !reflect.DeepEqual(session, want) {
+				t.Fatal(session, err)
+			}
+			if session, err := store.Session("other"); err != nil || session != nil {
+				t.Fatal(session, err)
+			}
+
+			game := &ArchivedGame{ArchiveId: "stored-1", SessionId: "stored", Ended: 1, Events: events}
+			if err := store.Archive(game); err != nil {
+				t.Fatal(err)
+			}
+			if archived, err := store.Archived("stored-1"); err != nil || !reflect.DeepEqual(archived, game) {
+				t.Fatal(archived, err)
+			}
+			if archived, err := store.Archived("missing"); err != nil || archived != nil {
+				t.Fatal(archived, err)
+			}
+			if history, err := store.History(); err != nil || len(history) != 1 {
+				t.Fatal(history, err)
+			}
+		})
+	}
+}
+
+func TestJSONStoreRecovery(t *testing.T) {
+	b, _ := NewBingoGame("torn")
+	b.joinPlayer("ann", "t1")
+	b.dealCard("ann", card(1, 2, 3))
+	events := b.GameLog()
+
+	dir := t.TempDir()
+	store, err := OpenJSONStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(&StoredSession{SessionId: "torn/../id", Seq: 1, Events: events[:2]})
+	// Written again after an append that failed.
+	store.Append(&StoredSession{SessionId: "torn/../id", Seq: 2, Events: events[1:]})
+	// Cut short by a crash.
+	path := filepath.Join(dir, jsonStoreName("torn/../id", JSON_SESSION_EXT))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"session_id":"torn/../id","seq":3,"events":[{"seq"`)
+	f.Close()
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &StoredSession{SessionId: "torn/../id", Seq: 2, Events: events}
+	if len(loaded) != 1 || !reflect.DeepEqual(loaded[0], want) {
+		t.Fatalf("loaded %+v, want %+v", loaded, want)
+	}
+}
+
+func TestSessionSaver(t *testing.T) {
+	store := NewMemoryStore()
+	b, _ := NewBingoGame("saver")
+	h := NewSessionHub(b)
+	h.saver = newSessionSaver(store, b.GameId)
+	h.persist()
+	b.joinPlayer("ann", "t1")
+	b.dealCard("ann", card(1, 2, 3))
+	h.persist()
+	h.ownerToken = "owner"
+	h.persist()
+	b.drawNumber(1)
+	h.persist()
+	h.stopSaver()
+
+	loaded, _ := store.Load()
+	if len(loaded) != 1 || loaded[0].OwnerToken != "owner" || !reflect.DeepEqual(loaded[0].Events, b.GameLog()) {
+		t.Fatalf("saved %+v", loaded)
+	}
+}
+
+func TestRestoredWebhooks(t *testing.T) {
+	store := NewMemoryStore()
+	b, _ := NewBingoGame("hooked")
+	h := NewSessionHub(b)
+	h.saver = newSessionSaver(store, b.GameId)
+	h.ownerToken = "owner"
+	h.webhooks = append(h.webhooks, &Webhook{Id: "h1", URL: "https://example.com/hook", Events: []string{WEBHOOK_DRAW}, secret: []byte("s1"), public: true})
+	h.webhooksChanged = true
+	h.persist()
+	h.stopSaver()
+
+	session, _ := store.Session("hooked")
+	restored, err := restoredHub(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.webhooks, h.webhooks) {
+		t.Fatalf("restored %+v, want %+v", restored.webhooks, h.webhooks)
+	}
+
+	// Unsubscribing is saved too.
+	h.saver = newSessionSaver(store, b.GameId)
+	h.webhooks = nil
+	h.webhooksChanged = true
+	h.persist()
+	h.stopSaver()
+	if session, _ := store.Session("hooked"); len(session.Webhooks) != 0 {
+		t.Fatal(session.Webhooks)
+	}
+}
+
+func TestOpenStoredSession(t *testing.T) {
+	// Run by another instance before, which saved it to the shared store.
+	b, _ := NewBingoGame("handed-over")
+	b.joinPlayer("ann", "t1")
+	b.dealCard("ann", card(1, 2, 3))
+	b.drawNumber(1)
+	hooks := []StoredWebhook{{Id: "h1", URL: "https://example.com/hook", Events: []string{}, Secret: "s1"}}
+	sessionStore.Append(&StoredSession{SessionId: "handed-over", OwnerToken: "owner", Seq: 4, Events: b.GameLog(), Webhooks: hooks})
+
+	h := OpenSessionHub("handed-over")
+	var draws []int
+	var stored []StoredWebhook
+	var role string
+	h.call(func() {
+		draws = h.game.drawnNumbers()
+		stored = h.storedWebhooks()
+		role, _ = h.tokenRole("owner")
+	})
+	if !reflect.DeepEqual(draws, []int{1}) || !reflect.DeepEqual(stored, hooks) || role != ROLE_OWNER {
+		t.Fatal(draws, stored, role)
+	}
+}
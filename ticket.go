@@ -0,0 +1,158 @@
+/*
+*
+* Websocket handshake tickets.
+* A page first asks /ticket for a short lived ticket signed by the server
+* and passes it as the "ticket" query parameter of the websocket URL.
+* Upgrades without a valid, unused ticket for their role are rejected,
+* together with handshakes from origins that aren't allowed.
+*
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TicketResp struct {
+	Ticket  string `json:"ticket"`
+	Role    string `json:"role"`
+	Expires int64  `json:"expires"`
+}
+
+var ticketSecret []byte
+var ticketSecretOnce sync.Once
+
+// Nonces of redeemed tickets, kept until the ticket expires.
+var usedTickets map[string]time.Time
+var usedTicketsLock sync.Mutex
+
+func ticketKey() []byte {
+	ticketSecretOnce.Do(func() {
+		if serverConfig.TicketSecret != "" {
+			ticketSecret = []byte(serverConfig.TicketSecret)
+			return
+		}
+		// Tickets only have to survive until the upgrade, a key per
+		// process is enough.
+		ticketSecret = make([]byte, 32)
+		if _, err := rand.Read(ticketSecret); err != nil {
+			log.Panic(err)
+		}
+	})
+	return ticketSecret
+}
+
+func signTicket(payload string) string {
+	mac := hmac.New(sha256.New, ticketKey())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IssueTicket returns a ticket for role as role.expires.nonce.signature.
+func IssueTicket(role string, now time.Time) (string, time.Time) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Panic(err)
+	}
+	expires := now.Add(serverConfig.TicketTTL)
+	payload := role + "." + strconv.FormatInt(expires.Unix(), 10) + "." + hex.EncodeToString(nonce)
+	return payload + "." + signTicket(payload), expires
+}
+
+// RedeemTicket checks a ticket was issued by us for role and is still
+// valid. A ticket can only be redeemed once.
+func RedeemTicket(ticket string, role string, now time.Time) error {
+	parts := strings.Split(ticket, ".")
+	if len(parts) != 4 {
+		return fmt.Errorf("malformed ticket")
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(signTicket(payload)), []byte(parts[3])) {
+		return fmt.Errorf("bad ticket signature")
+	}
+	if parts[0] != role {
+		return fmt.Errorf("ticket issued for role %s", parts[0])
+	}
+	expiresUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed ticket expiry")
+	}
+	expires := time.Unix(expiresUnix, 0)
+	if now.After(expires) {
+		return fmt.Errorf("ticket expired")
+	}
+
+	usedTicketsLock.Lock()
+	defer usedTicketsLock.Unlock()
+	for nonce, exp := range usedTickets {
+		if now.After(exp) {
+			delete(usedTickets, nonce)
+		}
+	}
+	if _, ok := usedTickets[parts[2]]; ok {
+		return fmt.Errorf("ticket already used")
+	}
+	usedTickets[parts[2]] = expires
+	return nil
+}
+
+// originAllowed reports whether a browser request comes from an allowed
+// origin. Without an allowlist only the server's own host is accepted.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not a browser, tickets still apply.
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if len(serverConfig.AllowedOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range serverConfig.AllowedOrigins {
+		if strings.EqualFold(allowed, origin) || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func Ticket(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	if !originAllowed(r) {
+		log.Println("ticket refused for origin:", r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	role := r.URL.Query().Get("role")
+	if role != ROLE_ADMIN && role != ROLE_PLAYER && role != ROLE_SPECTATOR {
+		http.Error(w, "unknown role", http.StatusBadRequest)
+		return
+	}
+	ticket, expires := IssueTicket(role, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	ticketResp := TicketResp{Ticket: ticket, Role: role, Expires: expires.Unix()}
+	if err := json.NewEncoder(w).Encode(ticketResp); err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	usedTickets = make(map[string]time.Time)
+}
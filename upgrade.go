@@ -0,0 +1,161 @@
+/*
+*
+* Websocket upgrades.
+* Upgraders are built from the ServerConfig. The hijacked connection is
+* wrapped to count the bytes put on the wire, which gives the
+* compression ratio of every message type.
+*
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CompressionStats struct {
+	Messages  int64   `json:"messages"`
+	RawBytes  int64   `json:"raw_bytes"`
+	WireBytes int64   `json:"wire_bytes"`
+	Ratio     float64 `json:"ratio"`
+}
+
+// Compression stats by msg_type.
+var compressionStats map[string]*CompressionStats
+var compressionStatsLock sync.Mutex
+
+// countingConn counts the bytes written to the network.
+type countingConn struct {
+	net.Conn
+	written int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Written() int64 {
+	return atomic.LoadInt64(&c.written)
+}
+
+// countingResponseWriter hands a countingConn to the upgrader.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not implement http.Hijacker")
+	}
+	netConn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: netConn}
+	return w.conn, brw, nil
+}
+
+func NewUpgrader(cfg ServerConfig) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		HandshakeTimeout:  cfg.HandshakeTimeout,
+		EnableCompression: cfg.EnableCompression,
+		CheckOrigin:       originAllowed,
+	}
+}
+
+var upgrader = NewUpgrader(serverConfig)
+
+// upgradeClient checks the handshake ticket, upgrades the request to a
+// websocket and applies the per connection limits.
+func upgradeClient(w http.ResponseWriter, r *http.Request, role string) (*Client, error) {
+	if isShuttingDown() {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return nil, fmt.Errorf("%s: upgrade refused: server shutting down", r.RemoteAddr)
+	}
+	if err := RedeemTicket(r.URL.Query().Get("ticket"), role, time.Now()); err != nil {
+		http.Error(w, "invalid handshake ticket", http.StatusForbidden)
+		return nil, fmt.Errorf("%s: upgrade refused: %v", r.RemoteAddr, err)
+	}
+	ip := remoteIP(r)
+	if !acquireConnSlot(ip) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return nil, fmt.Errorf("%s: upgrade refused: too many connections", r.RemoteAddr)
+	}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	conn, err := upgrader.Upgrade(cw, r, nil)
+	if err != nil {
+		releaseConnSlot(ip)
+		return nil, err
+	}
+	conn.SetReadLimit(serverConfig.ReadLimit)
+	if serverConfig.EnableCompression {
+		conn.EnableWriteCompression(true)
+		if err := conn.SetCompressionLevel(serverConfig.CompressionLevel); err != nil {
+			conn.Close()
+			releaseConnSlot(ip)
+			return nil, err
+		}
+	}
+	client := NewClient(conn, role)
+	client.wire = cw.conn
+	client.ip = ip
+	return client, nil
+}
+
+// recordWrite adds a message written by the write pump to the stats of
+// its msg_type.
+func recordWrite(out *Outbound, wireBytes int64) {
+	msgType := out.msgType
+	if msgType == "" {
+		msgType = messageType(out.data)
+	}
+
+	compressionStatsLock.Lock()
+	defer compressionStatsLock.Unlock()
+	stats, ok := compressionStats[msgType]
+	if !ok {
+		stats = &CompressionStats{}
+		compressionStats[msgType] = stats
+	}
+	stats.Messages++
+	stats.RawBytes += int64(len(out.data))
+	stats.WireBytes += wireBytes
+	stats.Ratio = float64(stats.WireBytes) / float64(stats.RawBytes)
+}
+
+func messageType(msg []byte) string {
+	var typed struct {
+		Msg_Type string `json:"msg_type"`
+	}
+	if err := json.Unmarshal(msg, &typed); err != nil || typed.Msg_Type == "" {
+		return "unknown"
+	}
+	return typed.Msg_Type
+}
+
+func collectCompressionStats() map[string]CompressionStats {
+	compressionStatsLock.Lock()
+	defer compressionStatsLock.Unlock()
+	stats := make(map[string]CompressionStats)
+	for msgType, s := range compressionStats {
+		stats[msgType] = *s
+	}
+	return stats
+}
+
+func init() {
+	compressionStats = make(map[string]*CompressionStats)
+}
@@ -0,0 +1,597 @@
+/*
+*
+* Outbound webhooks.
+* Game events are posted as JSON to the webhooks of the deployment and
+* to the ones the owner of a session subscribed. A delivery is signed
+* with an HMAC of its body and retried with exponential backoff, one that
+* keeps failing is written to the dead-letter log. In test mode every
+* delivery goes to a local stand-in receiver instead.
+* Webhooks of a session are only posted to public addresses, checked
+* when they connect, unless their host is allowed. Redirects are not
+* followed.
+*
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+// Events posted to webhooks.
+//
+const (
+	WEBHOOK_SESSION_CREATED = "session_created"
+	WEBHOOK_PLAYER_JOINED   = "player_joined"
+	WEBHOOK_DRAW            = "draw"
+	WEBHOOK_PRIZE_WON       = "prize_won"
+	WEBHOOK_GAME_OVER       = "game_over"
+)
+
+//
+// Deliveries waiting for a worker, and workers posting them.
+//
+const (
+	WEBHOOK_QUEUE   = 1024
+	WEBHOOK_WORKERS = 4
+)
+
+//
+// Webhooks an owner may subscribe per session, and deliveries kept by
+// the test stand-in.
+//
+const (
+	WEBHOOK_SESSION_LIMIT = 10
+	WEBHOOK_TEST_KEEP     = 100
+)
+
+//
+// Headers of a delivery.
+//
+const (
+	WEBHOOK_EVENT_HEADER     = "X-Bingo-Event"
+	WEBHOOK_DELIVERY_HEADER  = "X-Bingo-Delivery"
+	WEBHOOK_SIGNATURE_HEADER = "X-Bingo-Signature"
+)
+
+var webhookEvents = []string{WEBHOOK_SESSION_CREATED, WEBHOOK_PLAYER_JOINED, WEBHOOK_DRAW,
+	WEBHOOK_PRIZE_WON, WEBHOOK_GAME_OVER}
+
+// Body of a delivery.
+type WebhookEvent struct {
+	Id         string      `json:"id"`
+	Event      string      `json:"event"`
+	Session_Id string      `json:"session_id"`
+	Instance   string      `json:"instance"`
+	Time       int64       `json:"time"`
+	Data       WebhookData `json:"data"`
+}
+
+// Details of an event, set as they apply.
+type WebhookData struct {
+	Game_Link   string `json:"game_link,omitempty"`
+	Player_Name string `json:"player_name,omitempty"`
+	Draw_Number int    `json:"draw_number,omitempty"`
+	// Numbers drawn so far.
+	Draws   int      `json:"draws,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Winners []string `json:"winners,omitempty"`
+}
+
+type Webhook struct {
+	Id  string
+	URL string
+	// Events posted to the webhook, all of them when empty.
+	Events []string
+	secret []byte
+	// Posted to public addresses only.
+	public bool
+}
+
+// Payload of add_webhook command.
+type AddWebhookPayload struct {
+	SessionId string   `json:"session_id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events,omitempty"`
+	// Key signing the deliveries, a random one is returned when empty.
+	Secret string `json:"secret,omitempty"`
+}
+
+// Payload of remove_webhook command.
+type RemoveWebhookPayload struct {
+	SessionId string `json:"session_id"`
+	WebhookId string `json:"webhook_id"`
+}
+
+// Ack of add_webhook.
+type WebhookAdded struct {
+	Webhook_Id string   `json:"webhook_id"`
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`
+	Secret     string   `json:"secret"`
+}
+
+// A delivery that failed for good, as written to the dead-letter log.
+type DeadLetter struct {
+	Delivery   string          `json:"delivery"`
+	Event      string          `json:"event"`
+	Session_Id string          `json:"session_id"`
+	Webhook_Id string          `json:"webhook_id"`
+	URL        string          `json:"url"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error"`
+	Failed     int64           `json:"failed"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// A delivery received by the test stand-in.
+type WebhookReceipt struct {
+	Path      string          `json:"path"`
+	Event     string          `json:"event"`
+	Delivery  string          `json:"delivery"`
+	Signature string          `json:"signature"`
+	Status    int             `json:"status"`
+	Body      json.RawMessage `json:"body"`
+}
+
+type WebhookReceipts struct {
+	URL        string           `json:"url"`
+	Deliveries []WebhookReceipt `json:"deliveries"`
+}
+
+type webhookDelivery struct {
+	hook     *Webhook
+	event    *WebhookEvent
+	body     []byte
+	attempts int
+	err      error
+}
+
+// Local receiver standing in for every webhook in test mode. Paths
+// starting with /fail are answered with an error.
+type webhookStandIn struct {
+	url      string
+	mu       sync.Mutex
+	received []WebhookReceipt
+}
+
+// Webhooks every session posts to.
+var deploymentWebhooks []*Webhook
+
+var webhookQueue chan *webhookDelivery
+var webhookClient = &http.Client{Timeout: 5 * time.Second, CheckRedirect: noRedirect}
+var publicWebhookClient = newPublicWebhookClient(5 * time.Second)
+var webhookTest *webhookStandIn
+var deadLetterLock sync.Mutex
+
+// startWebhooks sets up the webhooks of the deployment and starts the
+// workers posting deliveries.
+func startWebhooks(cfg ServerConfig) error {
+	webhookClient = &http.Client{Timeout: cfg.WebhookTimeout, CheckRedirect: noRedirect}
+	publicWebhookClient = newPublicWebhookClient(cfg.WebhookTimeout)
+	webhookURLs := cfg.Webhooks
+	if cfg.WebhookTest {
+		standIn, err := startWebhookStandIn()
+		if err != nil {
+			return err
+		}
+		webhookTest = standIn
+		if len(webhookURLs) == 0 {
+			webhookURLs = []string{standIn.url + "/"}
+		}
+		log.Println("Webhooks in test mode, deliveries go to", standIn.url)
+	}
+	secret := []byte(cfg.WebhookSecret)
+	if len(webhookURLs) > 0 && len(secret) == 0 {
+		secret = []byte(newWebhookSecret())
+		log.Println("No webhook secret set, deliveries are signed with a key of this process")
+	}
+	if err := checkWebhookEvents(cfg.WebhookEvents); err != nil {
+		return err
+	}
+	hooks := make([]*Webhook, 0, len(webhookURLs))
+	for i, u := range webhookURLs {
+		if err := checkWebhookURL(u); err != nil {
+			return err
+		}
+		hooks = append(hooks, &Webhook{Id: fmt.Sprint("deployment-", i+1), URL: u, Events: cfg.WebhookEvents, secret: secret})
+	}
+	deploymentWebhooks = hooks
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		go deliverWebhooks()
+	}
+	return nil
+}
+
+func newWebhookSecret() string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Panic(err)
+	}
+	return hex.EncodeToString(secret)
+}
+
+func checkWebhookURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook url must be an absolute http(s) url: %q", u)
+	}
+	return nil
+}
+
+// checkSessionWebhookURL checks the url of a session webhook doesn't
+// name a local or private address. Host names are resolved when the
+// delivery connects, by dialPublic.
+func checkSessionWebhookURL(u string) error {
+	if err := checkWebhookURL(u); err != nil {
+		return err
+	}
+	parsed, _ := url.Parse(u)
+	host := strings.ToLower(parsed.Hostname())
+	if webhookHostAllowed(host) {
+		return nil
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("webhook url must not be local: %q", u)
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicAddress(ip) {
+		return fmt.Errorf("webhook url must be on a public address: %q", u)
+	}
+	return nil
+}
+
+func webhookHostAllowed(host string) bool {
+	for _, allowed := range serverConfig.WebhookAllow {
+		if strings.EqualFold(allowed, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddress reports whether ip is neither the server itself nor on a
+// private, link-local or multicast network.
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// dialPublic refuses connections to addresses that aren't public, after
+// the host name was resolved.
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("webhook address is not public: %s", address)
+	}
+	return nil
+}
+
+// newPublicWebhookClient returns the client posting to session webhooks,
+// which connects to public addresses only and without a proxy.
+func newPublicWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialPublic}
+	return &http.Client{Timeout: timeout,
+		CheckRedirect: noRedirect,
+		Transport: &http.Transport{DialContext: dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: WEBHOOK_WORKERS}}
+}
+
+// noRedirect makes a redirect the answer of a delivery, which fails it.
+func noRedirect(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+func checkWebhookEvents(events []string) error {
+	for _, event := range events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return fmt.Errorf("unknown webhook event: %q", event)
+		}
+	}
+	return nil
+}
+
+func (hook *Webhook) wants(event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// sign returns the signature header of body.
+func (hook *Webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, hook.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// target is the URL a delivery is posted to, on the stand-in in test
+// mode.
+func (hook *Webhook) target() string {
+	if webhookTest == nil {
+		return hook.URL
+	}
+	u, _ := url.Parse(hook.URL)
+	return webhookTest.url + u.RequestURI()
+}
+
+// notify posts event to the webhooks of the deployment and the session
+// that want it.
+func (h *SessionHub) notify(event string, data WebhookData) {
+	hooks := make([]*Webhook, 0)
+	for _, hook := range deploymentWebhooks {
+		if hook.wants(event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	for _, hook := range h.webhooks {
+		if hook.wants(event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	ev := &WebhookEvent{Id: newResumeToken(),
+		Event:      event,
+		Session_Id: h.game.GameId,
+		Instance:   instanceId,
+		Time:       time.Now().Unix(),
+		Data:       data}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, hook := range hooks {
+		queueWebhook(&webhookDelivery{hook: hook, event: ev, body: body})
+	}
+}
+
+// queueWebhook hands a delivery to the workers without blocking the
+// hub, a delivery that doesn't fit in the queue is dead.
+func queueWebhook(d *webhookDelivery) {
+	select {
+	case webhookQueue <- d:
+	default:
+		d.err = fmt.Errorf("delivery queue is full")
+		writeDeadLetter(d)
+	}
+}
+
+// deliverWebhooks posts queued deliveries. A failed one is queued again
+// after the backoff, which doubles with every attempt.
+func deliverWebhooks() {
+	for d := range webhookQueue {
+		d.attempts++
+		if d.err = d.post(); d.err == nil {
+			continue
+		}
+		log.Println("webhook", d.hook.Id, d.event.Event, "attempt", d.attempts, "failed:", d.err)
+		if d.attempts > serverConfig.WebhookRetries {
+			writeDeadLetter(d)
+			continue
+		}
+		retry := d
+		time.AfterFunc(serverConfig.WebhookBackoff<<uint(d.attempts-1), func() {
+			queueWebhook(retry)
+		})
+	}
+}
+
+func (d *webhookDelivery) post() error {
+	req, err := http.NewRequest(http.MethodPost, d.hook.target(), bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_EVENT_HEADER, d.event.Event)
+	req.Header.Set(WEBHOOK_DELIVERY_HEADER, d.event.Id)
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, d.hook.sign(d.body))
+	client := webhookClient
+	if d.hook.public && webhookTest == nil {
+		client = publicWebhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// writeDeadLetter appends a failed delivery to the dead-letter log, the
+// server log when there is no file.
+func writeDeadLetter(d *webhookDelivery) {
+	line, _ := json.Marshal(DeadLetter{Delivery: d.event.Id,
+		Event:      d.event.Event,
+		Session_Id: d.event.Session_Id,
+		Webhook_Id: d.hook.Id,
+		URL:        d.hook.URL,
+		Attempts:   d.attempts,
+		Error:      d.err.Error(),
+		Failed:     time.Now().Unix(),
+		Body:       d.body})
+	log.Println("webhook dead letter:", string(line))
+	if serverConfig.WebhookDeadLetter == "" {
+		return
+	}
+	deadLetterLock.Lock()
+	defer deadLetterLock.Unlock()
+	f, err := os.OpenFile(serverConfig.WebhookDeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Println(err)
+	}
+}
+
+// addWebhook subscribes a webhook to the events of the session.
+func (h *SessionHub) addWebhook(c *Client, cmd *Command) {
+	var payload AddWebhookPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	err := checkSessionWebhookURL(payload.URL)
+	if err == nil {
+		err = checkWebhookEvents(payload.Events)
+	}
+	if err != nil {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "%v", err))
+		return
+	}
+	if len(h.webhooks) >= WEBHOOK_SESSION_LIMIT {
+		sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "session %s already has %d webhooks", h.game.GameId, WEBHOOK_SESSION_LIMIT))
+		return
+	}
+	if payload.Secret == "" {
+		payload.Secret = newWebhookSecret()
+	}
+	if payload.Events == nil {
+		payload.Events = []string{}
+	}
+	parsed, _ := url.Parse(payload.URL)
+	hook := &Webhook{Id: newResumeToken()[:12],
+		URL:    payload.URL,
+		Events: payload.Events,
+		secret: []byte(payload.Secret),
+		public: !webhookHostAllowed(parsed.Hostname())}
+	h.webhooks = append(h.webhooks, hook)
+	h.webhooksChanged = true
+	log.Println("Admin: webhook", hook.Id, "added to", h.game.GameId, hook.URL)
+	sendReply(c, NewAckReply(cmd, WebhookAdded{Webhook_Id: hook.Id, URL: hook.URL, Events: hook.Events, Secret: payload.Secret}))
+}
+
+// storedWebhooks returns the webhooks of the session as saved with it.
+func (h *SessionHub) storedWebhooks() []StoredWebhook {
+	stored := make([]StoredWebhook, 0, len(h.webhooks))
+	for _, hook := range h.webhooks {
+		stored = append(stored, StoredWebhook{Id: hook.Id, URL: hook.URL, Events: hook.Events, Secret: string(hook.secret)})
+	}
+	return stored
+}
+
+// restoredWebhook returns a saved webhook, posted to public addresses
+// unless its host is allowed now.
+func restoredWebhook(stored StoredWebhook) *Webhook {
+	parsed, _ := url.Parse(stored.URL)
+	return &Webhook{Id: stored.Id,
+		URL:    stored.URL,
+		Events: stored.Events,
+		secret: []byte(stored.Secret),
+		public: parsed == nil || !webhookHostAllowed(parsed.Hostname())}
+}
+
+// removeWebhook drops a webhook of the session, deliveries already
+// queued are still made.
+func (h *SessionHub) removeWebhook(c *Client, cmd *Command) {
+	var payload RemoveWebhookPayload
+	if err := cmd.DecodePayload(&payload); err != nil {
+		sendError(c, cmd, err)
+		return
+	}
+	for i, hook := range h.webhooks {
+		if hook.Id == payload.WebhookId {
+			h.webhooks = append(h.webhooks[:i], h.webhooks[i+1:]...)
+			h.webhooksChanged = true
+			log.Println("Admin: webhook", hook.Id, "removed from", h.game.GameId)
+			sendReply(c, NewAckReply(cmd, nil))
+			return
+		}
+	}
+	sendError(c, cmd, NewProtocolError(ERR_INVALID_PAYLOAD, "no webhook %q in session %s", payload.WebhookId, h.game.GameId))
+}
+
+// startWebhookStandIn listens on a local port for the deliveries of the
+// test mode.
+func startWebhookStandIn() (*webhookStandIn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	standIn := &webhookStandIn{url: "http://" + ln.Addr().String()}
+	go func() {
+		log.Println(http.Serve(ln, standIn))
+	}()
+	return standIn, nil
+}
+
+func (s *webhookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	status := http.StatusNoContent
+	if strings.HasPrefix(r.URL.Path, "/fail") {
+		status = http.StatusServiceUnavailable
+	}
+	receipt := WebhookReceipt{Path: r.URL.Path,
+		Event:     r.Header.Get(WEBHOOK_EVENT_HEADER),
+		Delivery:  r.Header.Get(WEBHOOK_DELIVERY_HEADER),
+		Signature: r.Header.Get(WEBHOOK_SIGNATURE_HEADER),
+		Status:    status}
+	if json.Valid(body) {
+		receipt.Body = body
+	}
+	log.Println("webhook stand-in:", r.URL.Path, receipt.Event, status)
+
+	s.mu.Lock()
+	s.received = append(s.received, receipt)
+	if len(s.received) > WEBHOOK_TEST_KEEP {
+		s.received = s.received[len(s.received)-WEBHOOK_TEST_KEEP:]
+	}
+	s.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+// WebhookTestDeliveries lists the deliveries the stand-in received last,
+// only in test mode.
+func WebhookTestDeliveries(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("API: ", r.URL.Path)
+	if webhookTest == nil {
+		http.Error(w, "webhooks aren't in test mode", http.StatusNotFound)
+		return
+	}
+	webhookTest.mu.Lock()
+	receipts := WebhookReceipts{URL: webhookTest.url, Deliveries: append([]WebhookReceipt{}, webhookTest.received...)}
+	webhookTest.mu.Unlock()
+	writeAPI(w, http.StatusOK, receipts)
+}
+
+func init() {
+	webhookQueue = make(chan *webhookDelivery, WEBHOOK_QUEUE)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckSessionWebhookURL(t *testing.T) {
+	defer func(allow []string) { serverConfig.WebhookAllow = allow }(serverConfig.WebhookAllow)
+	serverConfig.WebhookAllow = []string{"hooks.internal"}
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://example.com/hook", true},
+		{"http://93.184.216.34:8080/hook", true},
+		{"http://hooks.internal/hook", true},
+		{"ftp://example.com/hook", false},
+		{"/hook", false},
+		{"http://localhost/hook", false},
+		{"http://api.localhost/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://10.0.0.8/hook", false},
+		{"http://192.168.1.1/hook", false},
+		{"http://172.16.0.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[fe80::1]/hook", false},
+		{"http://0.0.0.0/hook", false},
+	}
+	for _, tt := range tests {
+		if err := checkSessionWebhookURL(tt.url); (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.url, err)
+		}
+	}
+}
+
+func TestWebhookClients(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer target.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer redirect.Close()
+
+	// The address is checked when the delivery connects.
+	if _, err := publicWebhookClient.Post(target.URL, "application/json", nil); err == nil {
+		t.Fatal("posted to a loopback address")
+	}
+	resp, err := webhookClient.Post(redirect.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatal("followed a redirect:", resp.Status)
+	}
+}